@@ -0,0 +1,175 @@
+package gemsite
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Access log formats
+const (
+	AccessLogText   = "text"
+	AccessLogJSON   = "json"
+	AccessLogCommon = "common"
+)
+
+// Creates the access logger for a configuration.
+// Returns the log file as well, if the log is written to a file.
+func newAccessLogger(config AccessLogConfig) (*slog.Logger, *logFile, error) {
+	var w io.Writer = os.Stderr
+	var file *logFile
+	if config.File != "" {
+		file = &logFile{path: config.File}
+		if err := file.reopen(); err != nil {
+			return nil, nil, err
+		}
+		w = file
+	}
+	var h slog.Handler
+	switch config.Format {
+	case AccessLogJSON:
+		h = slog.NewJSONHandler(w, nil)
+	case AccessLogCommon:
+		h = &commonLogHandler{w: w}
+	default:
+		h = slog.NewTextHandler(w, nil)
+	}
+	return slog.New(h), file, nil
+}
+
+// Logs a request.
+// url is the raw request line if it could not be parsed.
+func logRequest(logger *slog.Logger, remoteAddr string, url string, status int, size int64, duration time.Duration, fingerprint string, sni string) {
+	logger.LogAttrs(context.Background(), slog.LevelInfo, "request",
+		slog.String("remote_addr", remoteAddr),
+		slog.String("url", url),
+		slog.Int("status", status),
+		slog.Int64("bytes", size),
+		slog.Duration("duration", duration),
+		slog.String("cert", fingerprint),
+		slog.String("sni", sni),
+	)
+}
+
+// Logs a request handled by the server
+func (s *Server) logRequest(conn net.Conn, url string, w *statusWriter, duration time.Duration) {
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if s.config.AccessLog.AnonymizeIPs {
+		addr = anonymizeIP(addr)
+	}
+	cstate := conn.(*tls.Conn).ConnectionState()
+	cert := ""
+	if len(cstate.PeerCertificates) > 0 {
+		cert = fingerprint(cstate.PeerCertificates[0])
+	}
+	logRequest(s.accessLog, addr, url, w.status, w.size, duration, cert, cstate.ServerName)
+}
+
+// Removes the host part of an IP address: the last octet of IPv4 addresses,
+// and all but the first 48 bits of IPv6 addresses
+func anonymizeIP(s string) string {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return s
+	}
+	bits := 48
+	if addr.Unmap().Is4() {
+		addr, bits = addr.Unmap(), 24
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix.Addr().String()
+}
+
+// A log file that can be reopened after it was rotated
+type logFile struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+func (l *logFile) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Write(b)
+}
+
+// (Re)opens the file, closing the previous one
+func (l *logFile) reopen() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		l.f.Close()
+	}
+	l.f = f
+	return nil
+}
+
+// Writes request records in a format similar to the Common Log Format:
+//
+//	host - cert [time] "url" status bytes duration "sni"
+//
+// Missing values are written as "-". Other records are written as their
+// message.
+type commonLogHandler struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+func (h *commonLogHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *commonLogHandler) Handle(_ context.Context, r slog.Record) error {
+	attrs := map[string]string{}
+	var duration time.Duration
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "duration" {
+			duration = a.Value.Duration()
+		}
+		attrs[a.Key] = a.Value.String()
+		return true
+	})
+	field := func(key string) string {
+		if v := attrs[key]; v != "" {
+			return v
+		}
+		return "-"
+	}
+	var line string
+	if r.Message == "request" {
+		line = fmt.Sprintf("%s - %s [%s] %s %s %s %.3f %s\n",
+			field("remote_addr"), field("cert"), r.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			strconv.Quote(field("url")), field("status"), field("bytes"), duration.Seconds(),
+			strconv.Quote(field("sni")))
+	} else {
+		line = r.Message + "\n"
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, line)
+	return err
+}
+
+// Attributes and groups are not supported
+func (h *commonLogHandler) WithAttrs([]slog.Attr) slog.Handler {
+	return h
+}
+
+func (h *commonLogHandler) WithGroup(string) slog.Handler {
+	return h
+}
@@ -0,0 +1,322 @@
+package gemsite
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net/url"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A built-in administration page, listed on the administration index
+type adminRoute struct {
+	path    string
+	title   string
+	handler Handler
+}
+
+// Returns the built-in administration pages
+func (s *Server) adminRoutes() []adminRoute {
+	return []adminRoute{
+		{"/_admin/stats", "Statistics", HandlerFunc(s.serveStats)},
+		{"/_admin/metrics", "Metrics (Prometheus)", HandlerFunc(s.serveMetrics)},
+		{"/_admin/clients", "Clients", HandlerFunc(s.serveClients)},
+		{"/_admin/allowlist", "Allowlist", HandlerFunc(s.serveAllowlist)},
+		{"/_admin/certificates", "Certificates", HandlerFunc(s.serveCertificates)},
+		{"/_admin/runtime", "Runtime", HandlerFunc(s.serveRuntime)},
+		{"/_admin/pprof/profile", "CPU profile", s.profileHandler(cpuProfile)},
+		{"/_admin/pprof/trace", "Execution trace", s.profileHandler(executionTrace)},
+		{"/_admin/pprof/block", "Blocking profile", s.profileHandler(blockProfile)},
+		{"/_admin/pprof/mutex", "Mutex contention profile", s.profileHandler(mutexProfile)},
+		{"/_admin/pprof/heap", "Heap profile", snapshotProfile("heap")},
+		{"/_admin/pprof/allocs", "Allocations profile", snapshotProfile("allocs")},
+		{"/_admin/pprof/goroutine", "Goroutines", snapshotProfile("goroutine")},
+	}
+}
+
+// Serves the administration index on /_admin, and the files under /_admin/
+// otherwise
+func (s *Server) adminIndex(files Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		if r.URL.Path != "/_admin" && r.URL.Path != "/_admin/" {
+			files.ServeGemini(w, r)
+			return
+		}
+		w.WriteHeader(StatusSuccess, gemtextType(""))
+		fmt.Fprintf(w, "# Administration\n\n")
+		for _, route := range s.admin {
+			fmt.Fprintf(w, "=> %s %s\n", route.path, route.title)
+		}
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Profiles
+////////////////////////////////////////////////////////////////////////////////
+
+// Default duration of profiles collected over time
+const defaultProfileDuration = 20 * time.Second
+
+// Collects a profile over a period of time, written to w when finished
+type profiler func(w ResponseWriter, d time.Duration) error
+
+// Held while collecting a profile over time, as only one can be collected at
+// once
+var profiling sync.Mutex
+
+// Returns a handler collecting a profile over a period of time.
+// The duration (in seconds) is passed as the query (e.g. "?30" or
+// "?seconds=30"). Without query, the client is asked for the duration; an
+// empty answer uses the default.
+// The duration must be shorter than the write timeout.
+func (s *Server) profileHandler(collect profiler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		maxDuration := s.config.WriteTimeout.Duration - time.Second
+		// An empty answer to the prompt ("?") uses the default duration
+		if r.URL.RawQuery == "" && !r.URL.ForceQuery {
+			w.WriteHeader(StatusInput, fmt.Sprintf("Duration in seconds (default %d, maximum %d)", int(defaultProfileDuration.Seconds()), int(maxDuration.Seconds())))
+			return
+		}
+		input, _ := url.QueryUnescape(r.URL.RawQuery)
+		if seconds := r.URL.Query().Get("seconds"); seconds != "" {
+			input = seconds
+		}
+		d := defaultProfileDuration
+		if input = strings.TrimSpace(input); input != "" {
+			n, err := strconv.Atoi(input)
+			if err != nil {
+				Error(w, StatusBadRequest, "Invalid duration")
+				return
+			}
+			d = time.Duration(n) * time.Second
+		}
+		if d <= 0 || d > maxDuration {
+			Error(w, StatusBadRequest, fmt.Sprintf("Duration must be between 1 and %d seconds", int(maxDuration.Seconds())))
+			return
+		}
+		if !profiling.TryLock() {
+			Error(w, StatusTemporaryFailure, "Another profile is being collected")
+			return
+		}
+		defer profiling.Unlock()
+		if err := collect(w, d); err != nil {
+			log.Printf("error collecting profile: %v", err)
+			Error(w, StatusTemporaryFailure, "Unable to collect profile")
+		}
+	})
+}
+
+// Collects a CPU profile.
+// The header is written once profiling started, so an error starting it (e.g.
+// because another CPU profile is being collected) can still be reported.
+func cpuProfile(w ResponseWriter, d time.Duration) error {
+	if err := pprof.StartCPUProfile(&binaryWriter{w: w}); err != nil {
+		return err
+	}
+	time.Sleep(d)
+	pprof.StopCPUProfile()
+	return nil
+}
+
+// Collects an execution trace (see cpuProfile)
+func executionTrace(w ResponseWriter, d time.Duration) error {
+	if err := trace.Start(&binaryWriter{w: w}); err != nil {
+		return err
+	}
+	time.Sleep(d)
+	trace.Stop()
+	return nil
+}
+
+// Writes a binary response, writing the header on the first write
+type binaryWriter struct {
+	w           ResponseWriter
+	wroteHeader bool
+}
+
+func (b *binaryWriter) Write(p []byte) (int, error) {
+	if !b.wroteHeader {
+		b.w.WriteHeader(StatusSuccess, "application/octet-stream")
+		b.wroteHeader = true
+	}
+	return b.w.Write(p)
+}
+
+// Collects a blocking profile, of the events while collecting it
+func blockProfile(w ResponseWriter, d time.Duration) error {
+	return contentionProfile(w, d, "block", runtime.BlockProfile, func(on bool) {
+		if on {
+			runtime.SetBlockProfileRate(1)
+		} else {
+			runtime.SetBlockProfileRate(0)
+		}
+	})
+}
+
+// Collects a mutex contention profile, of the contention while collecting it
+func mutexProfile(w ResponseWriter, d time.Duration) error {
+	return contentionProfile(w, d, "mutex", runtime.MutexProfile, func(on bool) {
+		if on {
+			runtime.SetMutexProfileFraction(1)
+		} else {
+			runtime.SetMutexProfileFraction(0)
+		}
+	})
+}
+
+// Collects a contention profile (of blocking events or mutex contention) while
+// recording is turned on.
+// The runtime profiles are cumulative, so the profile is the difference between
+// the records before and after collecting. It is written in the text format of
+// the runtime (as with "debug=1"), which `go tool pprof` reads as well.
+func contentionProfile(w ResponseWriter, d time.Duration, name string, records func([]runtime.BlockProfileRecord) (int, bool), record func(on bool)) error {
+	before := map[[32]uintptr]runtime.BlockProfileRecord{}
+	for _, r := range contentionRecords(records) {
+		before[r.Stack0] = r
+	}
+	record(true)
+	// The header describes the recording rate, so is written while recording
+	var header bytes.Buffer
+	if err := pprof.Lookup(name).WriteTo(&header, 1); err != nil {
+		record(false)
+		return err
+	}
+	time.Sleep(d)
+	record(false)
+	var delta []runtime.BlockProfileRecord
+	for _, r := range contentionRecords(records) {
+		r.Count -= before[r.Stack0].Count
+		r.Cycles -= before[r.Stack0].Cycles
+		if r.Count > 0 {
+			delta = append(delta, r)
+		}
+	}
+	sort.Slice(delta, func(i, j int) bool { return delta[i].Cycles > delta[j].Cycles })
+
+	w.WriteHeader(StatusSuccess, "text/plain; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	// Header lines (e.g. "--- mutex:" and "cycles/second=..."), up to the
+	// first record
+	for _, line := range strings.Split(header.String(), "\n") {
+		if !strings.HasPrefix(line, "---") && !strings.Contains(line, "=") {
+			break
+		}
+		fmt.Fprintf(bw, "%s\n", line)
+	}
+	for _, r := range delta {
+		fmt.Fprintf(bw, "%d %d @", r.Cycles, r.Count)
+		for _, pc := range r.Stack() {
+			fmt.Fprintf(bw, " %#x", pc)
+		}
+		fmt.Fprintf(bw, "\n")
+		frames := runtime.CallersFrames(r.Stack())
+		for {
+			frame, more := frames.Next()
+			fmt.Fprintf(bw, "#\t%#x\t%s\t%s:%d\n", frame.PC, frame.Function, frame.File, frame.Line)
+			if !more {
+				break
+			}
+		}
+		fmt.Fprintf(bw, "\n")
+	}
+	return bw.Flush()
+}
+
+// Returns all records of a contention profile
+func contentionRecords(records func([]runtime.BlockProfileRecord) (int, bool)) []runtime.BlockProfileRecord {
+	n, _ := records(nil)
+	for {
+		// Leave room for records added in the meantime
+		result := make([]runtime.BlockProfileRecord, n+50)
+		var ok bool
+		if n, ok = records(result); ok {
+			return result[:n]
+		}
+	}
+}
+
+// Returns a handler writing a snapshot of a runtime profile.
+// With the query "debug=1", the profile is written as text.
+func snapshotProfile(name string) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		debug, _ := strconv.Atoi(r.URL.Query().Get("debug"))
+		if debug > 0 {
+			w.WriteHeader(StatusSuccess, "text/plain; charset=utf-8")
+		} else {
+			w.WriteHeader(StatusSuccess, "application/octet-stream")
+		}
+		if err := pprof.Lookup(name).WriteTo(w, debug); err != nil {
+			log.Printf("error writing %s profile: %v", name, err)
+		}
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Runtime
+////////////////////////////////////////////////////////////////////////////////
+
+// Lists the build, runtime, garbage collection and memory information
+func (s *Server) serveRuntime(w ResponseWriter, r *Request) {
+	w.WriteHeader(StatusSuccess, gemtextType(""))
+	fmt.Fprintf(w, "# Runtime\n\n")
+	fmt.Fprintf(w, "* Go version: %s\n", runtime.Version())
+	fmt.Fprintf(w, "* Platform: %s/%s\n", runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(w, "* Uptime: %v\n", time.Since(s.metrics.start).Round(time.Second))
+	fmt.Fprintf(w, "* CPUs: %d (GOMAXPROCS %d)\n", runtime.NumCPU(), runtime.GOMAXPROCS(0))
+	fmt.Fprintf(w, "* Goroutines: %d\n", runtime.NumGoroutine())
+
+	fmt.Fprintf(w, "\n## Build\n\n")
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		fmt.Fprintf(w, "* Module: %s %s\n", bi.Main.Path, bi.Main.Version)
+		for _, setting := range bi.Settings {
+			fmt.Fprintf(w, "* %s: %s\n", setting.Key, setting.Value)
+		}
+		for _, dep := range bi.Deps {
+			fmt.Fprintf(w, "* Dependency: %s %s\n", dep.Path, dep.Version)
+		}
+	} else {
+		fmt.Fprintf(w, "No build information available\n")
+	}
+
+	var gc debug.GCStats
+	debug.ReadGCStats(&gc)
+	fmt.Fprintf(w, "\n## Garbage collection\n\n")
+	fmt.Fprintf(w, "* Collections: %d\n", gc.NumGC)
+	if gc.NumGC > 0 {
+		fmt.Fprintf(w, "* Last collection: %v ago\n", time.Since(gc.LastGC).Round(time.Second))
+		fmt.Fprintf(w, "* Last pause: %v\n", gc.Pause[0])
+	}
+	fmt.Fprintf(w, "* Total pause: %v\n", gc.PauseTotal)
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	fmt.Fprintf(w, "\n## Memory\n\n")
+	fmt.Fprintf(w, "* Heap in use: %s\n", formatBytes(mem.HeapInuse))
+	fmt.Fprintf(w, "* Heap objects: %d\n", mem.HeapObjects)
+	fmt.Fprintf(w, "* Allocated: %s (%s in total)\n", formatBytes(mem.HeapAlloc), formatBytes(mem.TotalAlloc))
+	fmt.Fprintf(w, "* Obtained from the OS: %s\n", formatBytes(mem.Sys))
+	fmt.Fprintf(w, "* Next collection at: %s\n", formatBytes(mem.NextGC))
+}
+
+// Formats a number of bytes in binary units (e.g. "1.5 MiB")
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,311 @@
+package gemsite
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access level of a client certificate
+type Role int
+
+const (
+	RoleNone Role = iota
+
+	// Can access the admin paths (see HostConfig.AdminPaths)
+	RoleViewer
+
+	// Can also upload files using Titan
+	RoleEditor
+
+	// Can also access the administration pages
+	RoleAdmin
+)
+
+var roleNames = map[Role]string{
+	RoleViewer: "viewer",
+	RoleEditor: "editor",
+	RoleAdmin:  "admin",
+}
+
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return "none"
+}
+
+// Role of revoked certificates in the allowlist file
+const revokedRole = "revoked"
+
+// An allowlist entry
+type allowEntry struct {
+	role    Role
+	revoked bool
+	comment string
+}
+
+func (e allowEntry) roleName() string {
+	if e.revoked {
+		return revokedRole
+	}
+	return e.role.String()
+}
+
+// Roles of client certificates by fingerprint, loaded from a file.
+// Each line of the file consists of a SHA-256 fingerprint, a role (admin,
+// editor, viewer, or revoked), and an optional comment.
+type allowlist struct {
+	path string
+
+	mu      sync.RWMutex
+	entries map[string]allowEntry
+	modTime time.Time
+}
+
+// Loads the allowlist file.
+// A missing file is an empty allowlist.
+func (a *allowlist) load() error {
+	var modTime time.Time
+	entries := map[string]allowEntry{}
+	data, err := os.ReadFile(a.path)
+	if err == nil {
+		if fi, err := os.Stat(a.path); err == nil {
+			modTime = fi.ModTime()
+		}
+		s := bufio.NewScanner(bytes.NewReader(data))
+		for n := 1; s.Scan(); n++ {
+			line := strings.TrimSpace(s.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			fp, entry, err := parseAllowEntry(line)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", a.path, n, err)
+			}
+			entries[fp] = entry
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.entries = entries
+	a.modTime = modTime
+	return nil
+}
+
+// Reloads the allowlist file if it changed since it was loaded
+func (a *allowlist) reloadIfChanged() error {
+	var modTime time.Time
+	if fi, err := os.Stat(a.path); err == nil {
+		modTime = fi.ModTime()
+	}
+	a.mu.RLock()
+	changed := !modTime.Equal(a.modTime)
+	a.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+	log.Printf("reloading allowlist %s", a.path)
+	return a.load()
+}
+
+// Parses an allowlist line of the form `<fingerprint> <role> [<comment>]`
+func parseAllowEntry(line string) (string, allowEntry, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return "", allowEntry{}, fmt.Errorf("expected `<fingerprint> <role> [<comment>]`")
+	}
+	fp, ok := normalizeFingerprint(fields[0])
+	if !ok {
+		return "", allowEntry{}, fmt.Errorf("invalid fingerprint: %s", fields[0])
+	}
+	role := fields[1]
+	entry := allowEntry{comment: strings.Join(fields[2:], " ")}
+	if role == revokedRole {
+		entry.revoked = true
+		return fp, entry, nil
+	}
+	for r, name := range roleNames {
+		if name == role {
+			entry.role = r
+			return fp, entry, nil
+		}
+	}
+	return "", allowEntry{}, fmt.Errorf("invalid role: %s", role)
+}
+
+// Returns the fingerprint in lowercase hex, without "SHA256:" prefix or colons
+func normalizeFingerprint(s string) (string, bool) {
+	s = strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(s, "SHA256:"), "sha256:"))
+	s = strings.ReplaceAll(s, ":", "")
+	if len(s) != 64 || strings.Trim(s, "0123456789abcdef") != "" {
+		return "", false
+	}
+	return s, true
+}
+
+func (a *allowlist) lookup(fp string) (allowEntry, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	entry, ok := a.entries[fp]
+	return entry, ok
+}
+
+// Adds, changes or removes (if entry is nil) an entry, and stores the
+// allowlist
+func (a *allowlist) update(fp string, entry *allowEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entries := map[string]allowEntry{}
+	for k, v := range a.entries {
+		entries[k] = v
+	}
+	if entry == nil {
+		delete(entries, fp)
+	} else {
+		entries[fp] = *entry
+	}
+
+	var b strings.Builder
+	b.WriteString("# <fingerprint> <role> [<comment>]\n")
+	for _, fp := range sortedFingerprints(entries) {
+		e := entries[fp]
+		fmt.Fprintf(&b, "%s\n", strings.TrimSpace(fp+" "+e.roleName()+" "+e.comment))
+	}
+	f, err := os.CreateTemp(filepath.Dir(a.path), ".allowlist-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(b.String()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), a.path); err != nil {
+		return err
+	}
+	a.entries = entries
+	if fi, err := os.Stat(a.path); err == nil {
+		a.modTime = fi.ModTime()
+	}
+	return nil
+}
+
+func sortedFingerprints(entries map[string]allowEntry) []string {
+	fps := make([]string, 0, len(entries))
+	for fp := range entries {
+		fps = append(fps, fp)
+	}
+	sort.Strings(fps)
+	return fps
+}
+
+// Returns the role of the client certificate of a request.
+// Certificates listed in the allowlist have the listed role (including
+// self-signed certificates). Other certificates signed by a client CA with
+// the admin CN prefix are admins.
+// Returns ErrNoCertificate if there is no client certificate, and
+// ErrCertificateExpired if the certificate is outside its validity period.
+func (s *Server) roleOf(r *Request) (Role, error) {
+	if r.Certificate == nil {
+		return RoleNone, ErrNoCertificate
+	}
+	now := time.Now()
+	if now.Before(r.Certificate.NotBefore) || now.After(r.Certificate.NotAfter) {
+		return RoleNone, ErrCertificateExpired
+	}
+	if entry, ok := s.allowlist.lookup(fingerprint(r.Certificate)); ok {
+		if entry.revoked {
+			return RoleNone, fmt.Errorf("certificate revoked")
+		}
+		return entry.role, nil
+	}
+	if s.config.AdminCNPrefix == "" || !strings.HasPrefix(r.Certificate.Subject.CommonName, s.config.AdminCNPrefix) {
+		return RoleNone, nil
+	}
+	if err := r.VerifyCertificate(); err != nil {
+		return RoleNone, err
+	}
+	return RoleAdmin, nil
+}
+
+// Lists the allowlist
+func (s *Server) serveAllowlist(w ResponseWriter, r *Request) {
+	w.WriteHeader(StatusSuccess, gemtextType(""))
+	fmt.Fprintf(w, "# Allowlist\n\n")
+	fmt.Fprintf(w, "Your certificate: %s\n\n", fingerprint(r.Certificate))
+	if s.allowlist.path == "" {
+		fmt.Fprintf(w, "No allowlist file is configured; certificates are only authorized by their common name.\n")
+		return
+	}
+	s.allowlist.mu.RLock()
+	entries := s.allowlist.entries
+	s.allowlist.mu.RUnlock()
+	if len(entries) == 0 {
+		fmt.Fprintf(w, "No certificates\n")
+	}
+	for _, fp := range sortedFingerprints(entries) {
+		e := entries[fp]
+		fmt.Fprintf(w, "* %s %s %s\n", fp, e.roleName(), e.comment)
+	}
+	fmt.Fprintf(w, "\n=> /_admin/allowlist/set Add or change a certificate\n")
+	fmt.Fprintf(w, "=> /_admin/allowlist/remove Remove a certificate\n")
+}
+
+// Adds or changes an allowlist entry, given as the query
+func (s *Server) serveAllowlistSet(w ResponseWriter, r *Request) {
+	s.updateAllowlist(w, r, "Fingerprint, role (admin, editor, viewer or revoked), and comment", func(input string) (string, *allowEntry, error) {
+		fp, entry, err := parseAllowEntry(input)
+		return fp, &entry, err
+	})
+}
+
+// Removes an allowlist entry, given as the query
+func (s *Server) serveAllowlistRemove(w ResponseWriter, r *Request) {
+	s.updateAllowlist(w, r, "Fingerprint", func(input string) (string, *allowEntry, error) {
+		fp, ok := normalizeFingerprint(input)
+		if !ok {
+			return "", nil, fmt.Errorf("invalid fingerprint: %s", input)
+		}
+		return fp, nil, nil
+	})
+}
+
+func (s *Server) updateAllowlist(w ResponseWriter, r *Request, prompt string, parse func(string) (string, *allowEntry, error)) {
+	if s.allowlist.path == "" {
+		Error(w, StatusNotFound, "No allowlist file configured")
+		return
+	}
+	input, err := url.QueryUnescape(r.URL.RawQuery)
+	if err != nil || strings.TrimSpace(input) == "" {
+		w.WriteHeader(StatusInput, prompt)
+		return
+	}
+	fp, entry, err := parse(strings.TrimSpace(input))
+	if err != nil {
+		Error(w, StatusBadRequest, err.Error())
+		return
+	}
+	if err := s.allowlist.update(fp, entry); err != nil {
+		log.Printf("error updating allowlist: %v", err)
+		Error(w, StatusTemporaryFailure, "Unable to update allowlist")
+		return
+	}
+	log.Printf("%s: updated allowlist entry %s", r.RemoteAddr, fp)
+	Redirect(w, "/_admin/allowlist", StatusRedirectTemporary)
+}
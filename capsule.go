@@ -0,0 +1,280 @@
+package gemsite
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// A capsule, served for one or more host names
+type capsule struct {
+	config         HostConfig
+	content        fs.FS
+	redirects      map[string]redirect
+	searchTemplate *template.Template
+	ublogTemplate  *template.Template
+	certs          *certificates
+	mux            *ServeMux
+	handler        Handler
+	templates      fs.FS
+
+	// The search index, consisting of the base index (as generated by
+	// buildgemsite) and the index of uploaded pages
+	baseIndex   []byte
+	searchIndex *searchIndex
+	indexMu     sync.RWMutex
+
+	// Listings generated from the search index, by name. Nil if uploads are
+	// disabled. Protected by indexMu.
+	listings map[string][]byte
+
+	// Uploads. Nil if disabled.
+	uploads       *uploads
+	uploadHandler Handler
+
+	// Metrics of the server
+	metrics *metrics
+
+	// Rewrites links to the web version of the site. Nil if disabled.
+	localRE *regexp.Regexp
+
+	// Modification times of the files loaded by load(), for reloading in dev
+	// mode. In dev mode, requests hold a read lock on reloadMu, and reloads
+	// hold a write lock.
+	modTimes map[string]time.Time
+	reloadMu sync.RWMutex
+
+	// Microblog cache
+	statuses          []Status
+	lastStatusesFetch time.Time
+	statusesMu        sync.Mutex
+}
+
+// Loads a capsule.
+// Capsules without a certificate of their own use defaultCerts.
+func newCapsule(config HostConfig, defaultCerts *certificates) (*capsule, error) {
+	c := &capsule{config: config}
+	var err error
+
+	// Content
+	if config.ContentDir == "" {
+		if c.content, err = fs.Sub(assets, "gemsite"); err != nil {
+			return nil, err
+		}
+	} else {
+		c.content = os.DirFS(config.ContentDir)
+	}
+	if config.UploadDir != "" {
+		c.uploads = &uploads{dir: config.UploadDir}
+		c.content = listingsFS{c: c, fsys: overlayFS{upper: os.DirFS(config.UploadDir), lower: c.content}}
+		if err := c.uploads.loadIndex(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Templates
+	c.templates = os.DirFS(config.TemplateDir)
+	if config.TemplateDir == "" {
+		if c.templates, err = fs.Sub(templates, "templates"); err != nil {
+			return nil, err
+		}
+	}
+
+	// Search index, redirects & templates
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	// Certificates
+	c.certs = defaultCerts
+	if config.CertFile != "" || defaultCerts == nil {
+		if c.certs, err = newCertificates(config.CertFile, config.KeyFile, config.ClientCAFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.LocalURLPattern != "" {
+		c.localRE = regexp.MustCompile(config.LocalURLPattern)
+	}
+
+	c.mux = NewServeMux()
+	return c, nil
+}
+
+// Loads the search index, the redirects, and the templates.
+// Nothing changes if one of them fails to load.
+func (c *capsule) load() error {
+	modTimes := c.currentModTimes()
+
+	var idx []byte
+	rawRedirects := ""
+	if c.config.ContentDir == "" {
+		idx = searchidx
+		rawRedirects = redirectsidx
+	}
+	if c.config.SearchIndexFile != "" {
+		data, err := os.ReadFile(c.config.SearchIndexFile)
+		if err != nil {
+			return err
+		}
+		idx = data
+	}
+	if c.config.RedirectsFile != "" {
+		data, err := os.ReadFile(c.config.RedirectsFile)
+		if err != nil {
+			return err
+		}
+		rawRedirects = string(data)
+	}
+	redirects, err := loadRedirects(rawRedirects)
+	if err != nil {
+		return err
+	}
+	searchTemplate, err := template.ParseFS(c.templates, "search.gmi.tmpl")
+	if err != nil {
+		return err
+	}
+	ublogTemplate, err := template.ParseFS(c.templates, "ublog.gmi.tmpl")
+	if err != nil {
+		return err
+	}
+
+	oldIndex := c.baseIndex
+	c.baseIndex = idx
+	if err := c.reindex(); err != nil {
+		c.baseIndex = oldIndex
+		if c.config.SearchIndexFile != "" {
+			return fmt.Errorf("%s: %w", c.config.SearchIndexFile, err)
+		}
+		return fmt.Errorf("embedded search index: %w", err)
+	}
+	c.redirects = redirects
+	c.searchTemplate = searchTemplate
+	c.ublogTemplate = ublogTemplate
+	c.modTimes = modTimes
+	return nil
+}
+
+// Reloads the search index, the redirects, and the templates before handling
+// a request, if their files changed since they were loaded.
+// Used in dev mode.
+func (c *capsule) reloadOnChange(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		// The write lock waits for all requests in progress, so is only taken
+		// when reloading
+		modTimes := c.currentModTimes()
+		c.reloadMu.RLock()
+		changed := !maps.Equal(modTimes, c.modTimes)
+		c.reloadMu.RUnlock()
+		if changed {
+			c.reloadMu.Lock()
+			// Another request may have reloaded in the meantime
+			if !maps.Equal(c.currentModTimes(), c.modTimes) {
+				log.Printf("%v: reloading", c)
+				if err := c.load(); err != nil {
+					// Keep serving the previous version, and retry on the next request
+					log.Printf("%v: error reloading: %v", c, err)
+				}
+			}
+			c.reloadMu.Unlock()
+		}
+
+		c.reloadMu.RLock()
+		defer c.reloadMu.RUnlock()
+		next.ServeGemini(w, r)
+	})
+}
+
+// Returns the modification times of the search index, redirects, and template
+// files
+func (c *capsule) currentModTimes() map[string]time.Time {
+	result := map[string]time.Time{}
+	files := []string{c.config.SearchIndexFile, c.config.RedirectsFile}
+	if c.config.TemplateDir != "" {
+		entries, _ := os.ReadDir(c.config.TemplateDir)
+		for _, e := range entries {
+			files = append(files, filepath.Join(c.config.TemplateDir, e.Name()))
+		}
+	}
+	for _, f := range files {
+		if f == "" {
+			continue
+		}
+		if fi, err := os.Stat(f); err == nil {
+			result[f] = fi.ModTime()
+		}
+	}
+	return result
+}
+
+// Returns a description of the capsule for logging
+func (c *capsule) String() string {
+	if len(c.config.HostNames) > 0 {
+		return strings.Join(c.config.HostNames, ",")
+	}
+	return fmt.Sprintf("%s (from certificate)", strings.Join(c.certs.leaf().DNSNames, ","))
+}
+
+// Returns the current search index
+func (c *capsule) index() *searchIndex {
+	c.indexMu.RLock()
+	defer c.indexMu.RUnlock()
+	return c.searchIndex
+}
+
+// Rebuilds the search index from the base index and the uploaded pages, and
+// regenerates the listings if there are uploads
+func (c *capsule) reindex() error {
+	idxs := [][]byte{c.baseIndex}
+	if c.uploads != nil {
+		idxs = append(idxs, c.uploads.data)
+	}
+	index, err := loadSearchIndex(idxs...)
+	if err != nil {
+		return err
+	}
+	var listings map[string][]byte
+	if c.uploads != nil {
+		if listings, err = c.renderListings(index); err != nil {
+			return err
+		}
+	}
+	c.indexMu.Lock()
+	defer c.indexMu.Unlock()
+	c.searchIndex = index
+	c.listings = listings
+	return nil
+}
+
+// Checks whether a directory listing should be generated for a directory
+// without index
+func (c *capsule) listing(dir string) bool {
+	for _, d := range c.config.Listings {
+		if strings.HasPrefix(dir, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks whether the capsule serves the given host name
+func (c *capsule) serves(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if len(c.config.HostNames) > 0 {
+		for _, n := range c.config.HostNames {
+			if strings.EqualFold(n, host) {
+				return true
+			}
+		}
+		return false
+	}
+	return c.certs.leaf().VerifyHostname(host) == nil
+}
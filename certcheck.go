@@ -0,0 +1,195 @@
+package gemsite
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Interval at which the certificates are checked for expiry
+const certCheckInterval = 1 * time.Hour
+
+// Minimum key sizes, in bits
+const (
+	minRSAKeySize   = 2048
+	minECDSAKeySize = 256
+)
+
+// A certificate in use by the server
+type usedCertificate struct {
+	kind string // "server" or "client CA"
+	cert *x509.Certificate
+}
+
+// Returns the server and client CA certificates of all capsules
+func (s *Server) usedCertificates() []usedCertificate {
+	var result []usedCertificate
+	seen := map[string]bool{}
+	add := func(kind string, cert *x509.Certificate) {
+		fp := fingerprint(cert)
+		if !seen[fp] {
+			seen[fp] = true
+			result = append(result, usedCertificate{kind, cert})
+		}
+	}
+	for _, certs := range s.certificates() {
+		add("server", certs.leaf())
+		for _, ca := range certs.clientCAs() {
+			add("client CA", ca)
+		}
+	}
+	return result
+}
+
+// Returns the key type and size of a certificate (e.g. "ECDSA P-256"), and
+// the problems with its key or signature algorithm
+func keyInfo(cert *x509.Certificate) (string, []string) {
+	var desc string
+	var weak []string
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		desc = fmt.Sprintf("RSA %d bits", key.N.BitLen())
+		if key.N.BitLen() < minRSAKeySize {
+			weak = append(weak, fmt.Sprintf("weak key (RSA %d bits)", key.N.BitLen()))
+		}
+	case *ecdsa.PublicKey:
+		desc = fmt.Sprintf("ECDSA %s", key.Curve.Params().Name)
+		if key.Curve.Params().BitSize < minECDSAKeySize {
+			weak = append(weak, fmt.Sprintf("weak key (ECDSA %s)", key.Curve.Params().Name))
+		}
+	case ed25519.PublicKey:
+		desc = "Ed25519"
+	default:
+		desc = cert.PublicKeyAlgorithm.String()
+	}
+	switch cert.SignatureAlgorithm {
+	case x509.MD2WithRSA, x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1:
+		weak = append(weak, fmt.Sprintf("weak signature algorithm (%s)", cert.SignatureAlgorithm))
+	}
+	return desc, weak
+}
+
+// Returns the smallest warning threshold that the remaining validity is
+// within, or 0 if there is none
+func expiryThreshold(left time.Duration, warnings []Duration) time.Duration {
+	var result time.Duration
+	for _, w := range warnings {
+		if left <= w.Duration && (result == 0 || w.Duration < result) {
+			result = w.Duration
+		}
+	}
+	return result
+}
+
+// Logs warnings about certificates that expire soon or are weak.
+// warned holds the smallest expiry threshold already warned about for every
+// certificate (by fingerprint), so every warning is only logged once.
+// Expired certificates are logged at every check.
+func (s *Server) checkCertificates(warned map[string]time.Duration) {
+	now := time.Now()
+	for _, uc := range s.usedCertificates() {
+		cert := uc.cert
+		name := fmt.Sprintf("%s certificate %q", uc.kind, cert.Subject.CommonName)
+		fp := fingerprint(cert)
+		last, seen := warned[fp]
+		if !seen {
+			_, weak := keyInfo(cert)
+			for _, w := range weak {
+				log.Printf("warning: %s: %s", name, w)
+			}
+			last = math.MaxInt64
+		}
+		left := cert.NotAfter.Sub(now)
+		if left <= 0 {
+			log.Printf("warning: %s expired on %s", name, cert.NotAfter.Format(time.DateOnly))
+		} else if threshold := expiryThreshold(left, s.config.CertExpiryWarnings); threshold > 0 && threshold < last {
+			log.Printf("warning: %s expires in %s (on %s)", name, formatDays(left), cert.NotAfter.Format(time.DateOnly))
+			last = threshold
+		}
+		warned[fp] = last
+	}
+}
+
+// Checks the certificates at startup, and then periodically, until the server
+// shuts down
+func (s *Server) monitorCertificates() {
+	warned := map[string]time.Duration{}
+	s.checkCertificates(warned)
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.checkCertificates(warned)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Formats a duration in days (or hours, if shorter than a day)
+func formatDays(d time.Duration) string {
+	if d < 24*time.Hour {
+		return fmt.Sprintf("%d hours", int(d.Hours()))
+	}
+	return fmt.Sprintf("%d days", int(d.Hours()/24))
+}
+
+// Lists the server and client CA certificates with their remaining validity
+func (s *Server) serveCertificates(w ResponseWriter, r *Request) {
+	now := time.Now()
+	w.WriteHeader(StatusSuccess, gemtextType(""))
+	fmt.Fprintf(w, "# Certificates\n")
+	capsules := map[string][]string{}
+	for _, c := range s.capsules {
+		fp := fingerprint(c.certs.leaf())
+		capsules[fp] = append(capsules[fp], c.String())
+	}
+	for _, uc := range s.usedCertificates() {
+		cert := uc.cert
+		fp := fingerprint(cert)
+		fmt.Fprintf(w, "\n## %s (%s)\n\n", cert.Subject.CommonName, uc.kind)
+		if names := capsules[fp]; len(names) > 0 {
+			sort.Strings(names)
+			fmt.Fprintf(w, "* Capsules: %s\n", strings.Join(names, "; "))
+		}
+		fmt.Fprintf(w, "* Subject: %s\n", cert.Subject)
+		fmt.Fprintf(w, "* Issuer: %s\n", cert.Issuer)
+		if names := certNames(cert); len(names) > 0 {
+			fmt.Fprintf(w, "* Names: %s\n", strings.Join(names, ", "))
+		}
+		desc, weak := keyInfo(cert)
+		fmt.Fprintf(w, "* Key: %s\n", desc)
+		fmt.Fprintf(w, "* Signature algorithm: %s\n", cert.SignatureAlgorithm)
+		fmt.Fprintf(w, "* Valid: %s to %s\n", cert.NotBefore.Format(time.DateOnly), cert.NotAfter.Format(time.DateOnly))
+		if left := cert.NotAfter.Sub(now); left > 0 {
+			fmt.Fprintf(w, "* Remaining: %s\n", formatDays(left))
+			if expiryThreshold(left, s.config.CertExpiryWarnings) > 0 {
+				weak = append(weak, "expires soon")
+			}
+		} else {
+			weak = append(weak, "expired")
+		}
+		fmt.Fprintf(w, "* Fingerprint: %s\n", fp)
+		for _, warning := range weak {
+			fmt.Fprintf(w, "* Warning: %s\n", warning)
+		}
+	}
+}
+
+// Returns the DNS names and IP addresses of a certificate
+func certNames(cert *x509.Certificate) []string {
+	names := slices.Clone(cert.DNSNames)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
@@ -10,43 +10,38 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
-	"text/template"
-	"time"
-	"unicode"
-)
 
-const MinSearchWordLength = 3
+	"github.com/remko/gemsite/internal/searchindex"
+	"github.com/remko/gemsite/internal/site"
+	"github.com/remko/gemsite/internal/tokenizer"
+)
 
-var author = "Remko Tronçon"
 var contentDir = "gemsite"
 var contentSrcDir = "content"
-var generated = []string{"blog.gmi", "index.gmi"}
+var templateDir = "templates"
 
-func build() error {
-	site := Site{Posts: []Page{}}
+// Source file with redirects, in addition to the aliases of pages.
+// Consists of lines of the form `<from> <to> [<status>]`
+var redirectsFile = "_redirects"
+
+// Source file with the words not to index, replacing the default stop words
+// (tokenizer.DefaultStopWords).
+// Consists of whitespace-separated words, and comment lines starting with #.
+var stopWordsFile = "_stopwords"
 
+func build() error {
 	// Generate pages
 	pages, err := buildContent(contentSrcDir, contentDir)
 	if err != nil {
 		return err
 	}
 
-	// Collect posts
-	for _, page := range pages {
-		if strings.HasPrefix(page.Path, "blog/") && !page.Time.IsZero() && page.Title != "" {
-			site.Posts = append(site.Posts, page)
-		}
-	}
-	sort.Slice(site.Posts, func(i, j int) bool {
-		return site.Posts[i].Time.After(site.Posts[j].Time)
-	})
-
 	// Generate collection pages
-	for _, p := range generated {
-		tmpl := template.Must(template.ParseFiles(fmt.Sprintf("templates/%s.tmpl", p)))
+	s := site.NewSite(pages)
+	for _, p := range site.Generated {
 		f := CreateIfChangedFile(path.Join(contentDir, p))
 		defer f.Close()
-		if err := tmpl.Execute(f, site); err != nil {
+		if err := s.Render(os.DirFS(templateDir), p, f); err != nil {
 			return err
 		}
 		if err = f.Close(); err != nil {
@@ -55,26 +50,40 @@ func build() error {
 	}
 
 	// Index pages
+	stopWords, err := readStopWords(contentSrcDir)
+	if err != nil {
+		return err
+	}
 	f, err := os.Create("search.idx")
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	if err = writeSearchIndex(os.DirFS(contentDir), pages, f); err != nil {
+	if err = writeSearchIndex(os.DirFS(contentDir), pages, stopWords, f); err != nil {
 		return err
 	}
 	if err = f.Close(); err != nil {
 		return err
 	}
 
+	// Redirects
+	rf := CreateIfChangedFile("redirects.idx")
+	defer rf.Close()
+	if err = writeRedirects(contentSrcDir, pages, rf); err != nil {
+		return err
+	}
+	if err = rf.Close(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
-func buildContent(srcdir string, destdir string) ([]Page, error) {
+func buildContent(srcdir string, destdir string) ([]site.Page, error) {
 	srcfs := os.DirFS(srcdir)
-	pages := []Page{}
+	pages := []site.Page{}
 	err := fs.WalkDir(srcfs, ".", func(path string, d fs.DirEntry, err error) error {
-		if d.IsDir() {
+		if d.IsDir() || path == redirectsFile || path == stopWordsFile {
 			return nil
 		}
 		if strings.HasSuffix(path, ".md") {
@@ -86,7 +95,7 @@ func buildContent(srcdir string, destdir string) ([]Page, error) {
 			outp := path[:len(path)-3] + ".gmi"
 			outf := CreateIfChangedFile(filepath.Join(destdir, outp))
 			defer outf.Close()
-			page, err := ConvertMarkdownToGemtext(inf, outf)
+			page, err := site.ConvertMarkdownToGemtext(inf, outf)
 			if err != nil {
 				return fmt.Errorf("error converting %s: %w", path, err)
 			}
@@ -100,8 +109,8 @@ func buildContent(srcdir string, destdir string) ([]Page, error) {
 			if err := copyFile(filepath.Join(srcdir, path), filepath.Join(destdir, path)); err != nil {
 				return err
 			}
-			if strings.HasSuffix(path, ".gmi") && !contains(generated, path) && !strings.HasPrefix("_", path) {
-				page, err := parsePage(srcfs, path)
+			if strings.HasSuffix(path, ".gmi") && !contains(site.Generated, path) && !strings.HasPrefix("_", path) {
+				page, err := site.ParsePage(srcfs, path)
 				if err != nil {
 					return fmt.Errorf("%s: %w", path, err)
 				}
@@ -130,95 +139,109 @@ func copyFile(from, to string) error {
 	return outf.Close()
 }
 
-func parsePage(content fs.FS, path string) (Page, error) {
-	page := Page{}
-	f, err := content.Open(path)
-	if err != nil {
-		return page, err
+// Returns the stop words from the stop words file, or the default stop words
+// if there is none
+func readStopWords(srcdir string) ([]string, error) {
+	f, err := os.Open(filepath.Join(srcdir, stopWordsFile))
+	if os.IsNotExist(err) {
+		return tokenizer.DefaultStopWords, nil
+	} else if err != nil {
+		return nil, err
 	}
 	defer f.Close()
-	s := bufio.NewScanner(f)
-	for s.Scan() {
-		line := s.Text()
-		if line == "" {
-			continue
-		}
-		if page.Title == "" {
-			if !strings.HasPrefix(line, "# ") {
-				return page, fmt.Errorf("missing title")
-			}
-			page.Title = strings.Trim(line[1:], " ")
-		} else {
-			_, rawdate, found := strings.Cut(line, "·")
-			if found {
-				t, err := time.Parse("January _2, 2006", strings.Trim(rawdate, " "))
-				if err == nil {
-					page.Time = t
-				}
-			}
-			break
-		}
-	}
-	return page, s.Err()
+	return tokenizer.ReadStopWords(f)
 }
 
-func writeSearchIndex(content fs.FS, pages []Page, w io.Writer) error {
-	bw := bufio.NewWriter(w)
-	defer bw.Flush()
+// Writes the search index of the pages (see searchindex.Write)
+func writeSearchIndex(content fs.FS, pages []site.Page, stopWords []string, w io.Writer) error {
+	tok := tokenizer.New(stopWords)
+	docs := make([]searchindex.Document, 0, len(pages))
 	for _, page := range pages {
 		f, err := content.Open(page.Path)
 		if err != nil {
 			return err
 		}
 		defer f.Close()
-		tokens := map[string]struct{}{}
-		ls := bufio.NewScanner(f)
-		for ls.Scan() {
-			line := ls.Text()
-			if strings.HasPrefix(line, "=>") {
+		terms, text, err := site.IndexContent(f, tok)
+		if err != nil {
+			return err
+		}
+		docs = append(docs, site.IndexDocument(page, terms, text))
+	}
+	return searchindex.Write(w, stopWords, docs)
+}
+
+// Writes the redirects table, containing the redirects from the redirects
+// file, and the page aliases.
+// The table consists of lines of space-separated source path, target URL, and
+// status.
+func writeRedirects(srcdir string, pages []site.Page, w io.Writer) error {
+	redirects := map[string]string{}
+	add := func(from string, to string, status string) error {
+		if !strings.HasPrefix(from, "/") {
+			return fmt.Errorf("invalid redirect source: %s", from)
+		}
+		if status != "30" && status != "31" {
+			return fmt.Errorf("invalid redirect status for %s: %s", from, status)
+		}
+		if _, ok := redirects[from]; ok {
+			return fmt.Errorf("multiple redirects for %s", from)
+		}
+		redirects[from] = to + " " + status
+		return nil
+	}
+
+	for _, page := range pages {
+		for _, alias := range page.Aliases {
+			if err := add(alias, page.URL, "31"); err != nil {
+				return fmt.Errorf("%s: %w", page.Path, err)
+			}
+		}
+	}
+
+	f, err := os.Open(filepath.Join(srcdir, redirectsFile))
+	if err == nil {
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for n := 1; s.Scan(); n++ {
+			line := strings.TrimSpace(s.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
 				continue
 			}
-			words := strings.FieldsFunc(line, func(r rune) bool { return !unicode.IsLetter(r) })
-			for _, word := range words {
-				word = strings.ToLower(word)
-				if len(word) < MinSearchWordLength || word == "remko" || word == "tron\xc3\xa7on" {
-					continue
-				}
-				tokens[word] = struct{}{}
+			fields := strings.Fields(line)
+			if len(fields) == 2 {
+				fields = append(fields, "31")
+			}
+			if len(fields) != 3 {
+				return fmt.Errorf("%s:%d: expected `<from> <to> [<status>]`", redirectsFile, n)
+			}
+			if err := add(fields[0], fields[1], fields[2]); err != nil {
+				return fmt.Errorf("%s:%d: %w", redirectsFile, n, err)
 			}
 		}
-
-		// Write entry
-		bw.WriteString(page.URL)
-		bw.WriteByte(0)
-		bw.WriteString(page.Title)
-		bw.WriteByte(0)
-		bw.WriteString(page.Date())
-		for t := range tokens {
-			bw.WriteByte(0)
-			bw.WriteString(t)
+		if err := s.Err(); err != nil {
+			return err
 		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	froms := make([]string, 0, len(redirects))
+	for from := range redirects {
+		froms = append(froms, from)
+	}
+	sort.Strings(froms)
+	for _, from := range froms {
+		bw.WriteString(from)
+		bw.WriteByte(' ')
+		bw.WriteString(redirects[from])
 		bw.WriteByte(0xa)
 	}
 	return nil
 }
 
-type Site struct {
-	Posts []Page
-}
-
-type Page struct {
-	URL      string
-	Path     string
-	Time     time.Time
-	Title    string
-	Featured bool
-}
-
-func (p Page) Date() string {
-	return p.Time.Format(time.DateOnly)
-}
-
 func contains(s []string, str string) bool {
 	for _, v := range s {
 		if v == str {
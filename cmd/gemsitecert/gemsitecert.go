@@ -0,0 +1,193 @@
+// Generates the server certificate and client certificates, and reports
+// when certificates expire.
+//
+//	gemsitecert server [flags] <name>...
+//	gemsitecert client [flags] <common name>
+//	gemsitecert expiry [flags] <file>...
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"time"
+
+	"github.com/remko/gemsite/internal/certgen"
+)
+
+const day = 24 * time.Hour
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: gemsitecert server|client|expiry [flags] <args>\n")
+	fmt.Fprintf(os.Stderr, "Run `gemsitecert <command> -help` for the flags of a command.\n")
+	os.Exit(2)
+}
+
+// Generates a self-signed server certificate
+func server(args []string) error {
+	flags := flag.NewFlagSet("server", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: gemsitecert server [flags] <host name or IP>...\n")
+		flags.PrintDefaults()
+	}
+	certFile := flags.String("cert", "server.crt", "certificate `file` to create")
+	keyFile := flags.String("key", "server.key", "private key `file` to create")
+	keyType := flags.String("key-type", certgen.ECDSA, "key `type`: ecdsa (P-256) or ed25519")
+	days := flags.Int("days", 3650, "validity in days")
+	force := flags.Bool("force", false, "overwrite existing files")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	certPEM, keyPEM, err := certgen.Server(flags.Args(), *keyType, time.Duration(*days)*day)
+	if err != nil {
+		return err
+	}
+	return write(*certFile, certPEM, *keyFile, keyPEM, *force)
+}
+
+// Issues a client certificate signed by the server certificate
+func client(args []string) error {
+	flags := flag.NewFlagSet("client", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: gemsitecert client [flags] <common name>\n")
+		flags.PrintDefaults()
+	}
+	caCertFile := flags.String("ca-cert", "server.crt", "CA certificate `file`")
+	caKeyFile := flags.String("ca-key", "server.key", "CA private key `file`")
+	certFile := flags.String("cert", "admin.crt", "certificate `file` to create")
+	keyFile := flags.String("key", "admin.key", "private key `file` to create")
+	keyType := flags.String("key-type", certgen.ECDSA, "key `type`: ecdsa (P-256) or ed25519")
+	days := flags.Int("days", 365, "validity in days (limited by the validity of the CA)")
+	force := flags.Bool("force", false, "overwrite existing files")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	caCertPEM, err := os.ReadFile(*caCertFile)
+	if err != nil {
+		return err
+	}
+	caKeyPEM, err := os.ReadFile(*caKeyFile)
+	if err != nil {
+		return err
+	}
+	certPEM, keyPEM, err := certgen.Client(caCertPEM, caKeyPEM, flags.Arg(0), *keyType, time.Duration(*days)*day)
+	if err != nil {
+		return err
+	}
+	return write(*certFile, certPEM, *keyFile, keyPEM, *force)
+}
+
+// Lists when the certificates in the given files expire.
+// Fails if one of them expires within the warning period.
+func expiry(args []string) error {
+	flags := flag.NewFlagSet("expiry", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: gemsitecert expiry [flags] <file>...\n")
+		flags.PrintDefaults()
+	}
+	warnDays := flags.Int("warn-days", 30, "fail if a certificate expires within this number of days")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	now := time.Now()
+	expiring := 0
+	for _, file := range flags.Args() {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		certs, err := certgen.Parse(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		for _, cert := range certs {
+			left := cert.NotAfter.Sub(now)
+			status := fmt.Sprintf("expires in %d days", int(left/day))
+			if left <= 0 {
+				status = "expired"
+			}
+			if left < time.Duration(*warnDays)*day {
+				expiring++
+				status += " (!)"
+			}
+			fmt.Printf("%s: %s: %s on %s\n", file, cert.Subject.CommonName, status, cert.NotAfter.Format(time.DateOnly))
+		}
+	}
+	if expiring > 0 {
+		return fmt.Errorf("%d certificate(s) expire within %d days", expiring, *warnDays)
+	}
+	return nil
+}
+
+// Writes a certificate and its private key (readable only by the owner),
+// refusing to overwrite existing files unless forced
+func write(certFile string, certPEM []byte, keyFile string, keyPEM []byte, force bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !force {
+		flags |= os.O_EXCL
+		for _, file := range []string{certFile, keyFile} {
+			if _, err := os.Stat(file); err == nil {
+				return fmt.Errorf("%s already exists (use -force to overwrite)", file)
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	for _, f := range []struct {
+		name string
+		data []byte
+		perm os.FileMode
+	}{{keyFile, keyPEM, 0600}, {certFile, certPEM, 0644}} {
+		out, err := os.OpenFile(f.name, flags, f.perm)
+		if err != nil {
+			return err
+		}
+		// Overwritten files keep their permissions otherwise
+		if err := out.Chmod(f.perm); err != nil {
+			out.Close()
+			return err
+		}
+		if _, err := out.Write(f.data); err != nil {
+			out.Close()
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+	}
+	log.Printf("wrote %s and %s", certFile, keyFile)
+	return nil
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "server":
+		err = server(os.Args[2:])
+	case "client":
+		err = client(os.Args[2:])
+	case "expiry":
+		err = expiry(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
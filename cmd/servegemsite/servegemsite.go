@@ -1,10 +1,81 @@
 package main
 
-import "github.com/remko/gemsite"
+import (
+	"context"
+	"flag"
+	"log"
+	"os/signal"
+	"syscall"
+
+	"github.com/remko/gemsite"
+)
 
 func main() {
-	laddr := "0.0.0.0:1965"
-	if err := gemsite.Listen(laddr); err != nil {
-		panic(err)
+	config := gemsite.DefaultConfig()
+	configFile := flag.String("config", "", "JSON configuration `file`")
+	flag.StringVar(&config.Addr, "addr", config.Addr, "address to listen on")
+	flag.BoolVar(&config.Dev, "dev", config.Dev, "serve the build output in the working directory, and reload it when it changes")
+	flag.Var(&config.IdleTimeout, "idle-timeout", "time allowed for the handshake and start of the request")
+	flag.Var(&config.ReadTimeout, "read-timeout", "time allowed for reading the request")
+	flag.Var(&config.WriteTimeout, "write-timeout", "time allowed for writing the response")
+	flag.Var(&config.ShutdownTimeout, "shutdown-timeout", "time allowed for open connections to finish when shutting down")
+	flag.StringVar(&config.AccessLog.Format, "access-log-format", config.AccessLog.Format, "access log `format`: text, json or common")
+	flag.StringVar(&config.AccessLog.File, "access-log-file", config.AccessLog.File, "`file` to append the access log to, reopened on SIGHUP (default: standard error)")
+	flag.BoolVar(&config.AccessLog.AnonymizeIPs, "anonymize-ips", config.AccessLog.AnonymizeIPs, "remove the host part of client IP addresses from the access log")
+	flag.StringVar(&config.MetricsAddr, "metrics-addr", config.MetricsAddr, "local `address` to serve Prometheus metrics on over HTTP")
+	flag.IntVar(&config.MaxConnections, "max-connections", config.MaxConnections, "maximum number of concurrent connections (0 means no limit)")
+	flag.StringVar(&config.ContentDir, "content-dir", config.ContentDir, "content `directory` (default: embedded content)")
+	flag.StringVar(&config.SearchIndexFile, "search-index", config.SearchIndexFile, "search index `file` (default: embedded search index)")
+	flag.StringVar(&config.RedirectsFile, "redirects", config.RedirectsFile, "redirects `file` (default: embedded redirects)")
+	flag.StringVar(&config.TemplateDir, "template-dir", config.TemplateDir, "template `directory` (default: embedded templates)")
+	flag.StringVar(&config.UploadDir, "upload-dir", config.UploadDir, "`directory` storing Titan uploads (empty disables uploads)")
+	flag.Int64Var(&config.MaxUploadSize, "max-upload-size", config.MaxUploadSize, "maximum size of a Titan upload, in bytes")
+	flag.Var(&config.UploadTimeout, "upload-timeout", "time allowed for receiving a Titan upload")
+	flag.Var(&config.GatewayTimeout, "gateway-timeout", "time allowed for CGI and SCGI gateways to respond")
+	flag.Int64Var(&config.MaxGatewayResponseSize, "max-gateway-response-size", config.MaxGatewayResponseSize, "maximum size of CGI and SCGI responses, in bytes")
+	flag.StringVar(&config.CertFile, "cert-file", config.CertFile, "server certificate PEM `file` (default: embedded certificate)")
+	flag.StringVar(&config.KeyFile, "key-file", config.KeyFile, "server key PEM `file`")
+	flag.StringVar(&config.ClientCAFile, "client-ca-file", config.ClientCAFile, "client CA certificates PEM `file` (default: server certificate)")
+	flag.Var(&config.CertReloadInterval, "cert-reload-interval", "interval for checking certificate files for changes (0 disables)")
+	flag.StringVar(&config.MastodonHost, "mastodon-host", config.MastodonHost, "Mastodon `host` of the microblog account")
+	flag.StringVar(&config.MastodonID, "mastodon-id", config.MastodonID, "Mastodon account `id` of the microblog (empty disables the microblog)")
+	flag.Var(&config.MastodonFetchInterval, "mastodon-fetch-interval", "minimum time between Mastodon fetches")
+	flag.StringVar(&config.LocalURLPattern, "local-url-pattern", config.LocalURLPattern, "`regexp` matching web URLs that are rewritten to local links")
+	flag.StringVar(&config.AdminCNPrefix, "admin-cn-prefix", config.AdminCNPrefix, "common name `prefix` of admin client certificates (empty disables)")
+	flag.StringVar(&config.AllowlistFile, "allowlist-file", config.AllowlistFile, "`file` with fingerprints and roles of authorized client certificates")
+	flag.Parse()
+
+	// Settings from the config file are overridden by flags, so parse the
+	// flags again after loading the file
+	if *configFile != "" {
+		if err := gemsite.LoadConfig(*configFile, &config); err != nil {
+			log.Fatal(err)
+		}
+		flag.Parse()
+	}
+
+	server, err := gemsite.NewServer(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Shut down gracefully when stopped
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		stop()
+		sctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout.Duration)
+		defer cancel()
+		if err := server.Shutdown(sctx); err != nil {
+			log.Printf("error shutting down: %v", err)
+		}
+	}()
+
+	if err := server.ListenAndServe(); err != gemsite.ErrServerClosed {
+		log.Fatal(err)
 	}
+	<-shutdown
 }
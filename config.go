@@ -0,0 +1,431 @@
+package gemsite
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Server configuration
+type Config struct {
+	// Address to listen on
+	Addr string `json:"addr"`
+
+	// Time allowed for a client to complete the TLS handshake and start sending
+	// its request
+	IdleTimeout Duration `json:"idleTimeout"`
+
+	// Time allowed for reading the request line, once the client started sending
+	ReadTimeout Duration `json:"readTimeout"`
+
+	// Time allowed for writing the response.
+	// This needs to be large enough to cover long-running responses (e.g. profiles)
+	WriteTimeout Duration `json:"writeTimeout"`
+
+	// Time allowed for open connections to finish when shutting down
+	ShutdownTimeout Duration `json:"shutdownTimeout"`
+
+	// Maximum size of Titan uploads, in bytes
+	MaxUploadSize int64 `json:"maxUploadSize"`
+
+	// Time allowed for receiving a Titan upload
+	UploadTimeout Duration `json:"uploadTimeout"`
+
+	// Time allowed for a CGI or SCGI gateway to produce its complete response
+	GatewayTimeout Duration `json:"gatewayTimeout"`
+
+	// Maximum size of the response of a CGI or SCGI gateway, in bytes.
+	// Longer responses are truncated.
+	MaxGatewayResponseSize int64 `json:"maxGatewayResponseSize"`
+
+	// Access log of all requests
+	AccessLog AccessLogConfig `json:"accessLog"`
+
+	// Local address to serve the metrics on over HTTP, in the Prometheus text
+	// format (at /metrics). If empty, the metrics are only available on
+	// /_admin/metrics.
+	MetricsAddr string `json:"metricsAddr"`
+
+	// Maximum number of concurrent connections.
+	// Connections over the maximum are closed immediately. Zero means no limit.
+	MaxConnections int `json:"maxConnections"`
+
+	// Request budgets of clients
+	RateLimits RateLimits `json:"rateLimits"`
+
+	// Interval at which the certificate files are checked for changes.
+	// Zero disables checking; certificates are always reloaded on SIGHUP.
+	CertReloadInterval Duration `json:"certReloadInterval"`
+
+	// Remaining validity periods of the server and client CA certificates at
+	// which a warning is logged (e.g. ["720h", "168h"])
+	CertExpiryWarnings []Duration `json:"certExpiryWarnings"`
+
+	// Serve the default capsule from the build output in the working directory
+	// (gemsite/, search.idx, redirects.idx and templates/) instead of the
+	// embedded files, and reload the search index, redirects and templates of
+	// all capsules when they change
+	Dev bool `json:"dev"`
+
+	// Prefix of the common name of client certificates signed by the client
+	// CA that have admin access. Empty disables admin access by common name.
+	AdminCNPrefix string `json:"adminCNPrefix"`
+
+	// File listing the fingerprints and roles of authorized client
+	// certificates. Reloaded when it changes.
+	AllowlistFile string `json:"allowlistFile"`
+
+	// The default capsule
+	HostConfig
+
+	// Additional capsules, served based on the requested host name
+	Hosts []HostConfig `json:"hosts"`
+}
+
+// Configuration of a single capsule
+type HostConfig struct {
+	// Host names served by the capsule.
+	// If empty, the capsule serves the names its certificate is valid for.
+	HostNames []string `json:"hostNames"`
+
+	// Directory with the capsule content, as generated by buildgemsite.
+	// If empty, the content embedded in the binary is used.
+	ContentDir string `json:"contentDir"`
+
+	// Search index, as generated by buildgemsite.
+	// If empty, the embedded search index is used for the embedded content,
+	// and search is disabled otherwise.
+	SearchIndexFile string `json:"searchIndexFile"`
+
+	// Redirects table, as generated by buildgemsite.
+	// If empty, the embedded redirects are used for the embedded content, and
+	// no redirects are used otherwise.
+	RedirectsFile string `json:"redirectsFile"`
+
+	// Directory with the search.gmi.tmpl and ublog.gmi.tmpl templates.
+	// If empty, the embedded templates are used.
+	TemplateDir string `json:"templateDir"`
+
+	// Language of the capsule content (e.g. "en"), announced in the lang
+	// parameter of gemtext responses
+	Lang string `json:"lang"`
+
+	// Writable directory to store files uploaded by admins using Titan.
+	// Uploaded files take precedence over the capsule content.
+	// If empty, uploads are disabled.
+	UploadDir string `json:"uploadDir"`
+
+	// Gateways serving dynamic content from CGI executables or SCGI servers
+	Gateways []GatewayConfig `json:"gateways"`
+
+	// Directories (e.g. "/files/") for which a listing is generated if they
+	// have no index.gmi file, including their subdirectories.
+	// Other directories without index.gmi are not found.
+	Listings []string `json:"listings"`
+
+	// Path prefixes (e.g. "/drafts/") that are only accessible to admins,
+	// in addition to /_admin
+	AdminPaths []string `json:"adminPaths"`
+
+	// PEM files with the server certificate and key.
+	// If empty, the default capsule uses the certificate embedded in the
+	// binary, and other capsules use the certificates of the default capsule
+	// (including its client CAs).
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+
+	// PEM file with the CA certificates to verify client certificates against.
+	// If empty, the server certificate is used.
+	ClientCAFile string `json:"clientCAFile"`
+
+	// Mastodon account to serve the microblog from.
+	// If empty, the microblog is disabled.
+	MastodonHost string `json:"mastodonHost"`
+	MastodonID   string `json:"mastodonID"`
+
+	// Minimum time between fetches of new Mastodon statuses
+	MastodonFetchInterval Duration `json:"mastodonFetchInterval"`
+
+	// Regular expression matching the URL prefix of the web version of the site.
+	// Links matching this prefix are rewritten to local links if the capsule
+	// has the corresponding page.
+	LocalURLPattern string `json:"localURLPattern"`
+}
+
+// Configuration of a gateway, serving all paths under a prefix.
+// Exactly one of CGIDir and SCGIAddr must be set.
+type GatewayConfig struct {
+	// Path prefix served by the gateway (e.g. "/cgi-bin/")
+	Prefix string `json:"prefix"`
+
+	// Directory with CGI executables. The first path segment after the prefix
+	// selects the executable, the rest is passed as PATH_INFO.
+	CGIDir string `json:"cgiDir"`
+
+	// Address of an SCGI server: a Unix socket path, or a TCP host:port
+	SCGIAddr string `json:"scgiAddr"`
+}
+
+// Configuration of the access log
+type AccessLogConfig struct {
+	// Format of the log: "text" (slog key=value pairs), "json", or "common"
+	// (similar to the Common Log Format)
+	Format string `json:"format"`
+
+	// File to append the log to. If empty, the log is written to standard
+	// error. The file is reopened on SIGHUP (e.g. after rotation).
+	File string `json:"file"`
+
+	// Remove the host part of client IP addresses
+	AnonymizeIPs bool `json:"anonymizeIPs"`
+}
+
+// Request budgets of clients, per class of routes.
+// Clients over their budget get a 44 response. Admin routes are not limited.
+type RateLimits struct {
+	// Static files
+	Static RateLimit `json:"static"`
+
+	// Search
+	Search RateLimit `json:"search"`
+
+	// Dynamic routes (microblog and gateways)
+	Dynamic RateLimit `json:"dynamic"`
+
+	// Track clients with an allowlisted certificate or a certificate signed by
+	// a client CA by their certificate fingerprint instead of their IP address
+	ByCertificate bool `json:"byCertificate"`
+}
+
+// A token bucket: a client can make Burst requests at once, and Rate requests
+// per second on average. A zero rate disables limiting.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Addr:                   "0.0.0.0:1965",
+		IdleTimeout:            Duration{10 * time.Second},
+		ReadTimeout:            Duration{5 * time.Second},
+		WriteTimeout:           Duration{1 * time.Minute},
+		ShutdownTimeout:        Duration{30 * time.Second},
+		MaxUploadSize:          10 << 20,
+		UploadTimeout:          Duration{1 * time.Minute},
+		GatewayTimeout:         Duration{10 * time.Second},
+		MaxGatewayResponseSize: 10 << 20,
+		AccessLog:              AccessLogConfig{Format: AccessLogText},
+		MaxConnections:         256,
+		RateLimits: RateLimits{
+			Static:  RateLimit{Rate: 10, Burst: 50},
+			Search:  RateLimit{Rate: 1, Burst: 10},
+			Dynamic: RateLimit{Rate: 0.5, Burst: 10},
+		},
+		CertReloadInterval: Duration{1 * time.Minute},
+		CertExpiryWarnings: []Duration{{30 * 24 * time.Hour}, {7 * 24 * time.Hour}, {24 * time.Hour}},
+		AdminCNPrefix:      "admin@",
+		HostConfig: HostConfig{
+			Lang:                  "en",
+			MastodonHost:          "mas.to",
+			MastodonID:            "109530760716287685",
+			MastodonFetchInterval: Duration{1 * time.Hour},
+			LocalURLPattern:       `^https?://mko.re`,
+		},
+	}
+}
+
+// Reads a JSON configuration file on top of the given configuration.
+// Settings that are absent from the file keep their value.
+func LoadConfig(path string, config *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(config); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Checks the configuration for invalid or missing settings.
+// All problems are reported at once.
+func (c *Config) Validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		errs = append(errs, fmt.Errorf("addr: %w", err))
+	}
+	for _, d := range []struct {
+		name  string
+		value Duration
+	}{
+		{"idleTimeout", c.IdleTimeout},
+		{"readTimeout", c.ReadTimeout},
+		{"writeTimeout", c.WriteTimeout},
+		{"shutdownTimeout", c.ShutdownTimeout},
+		{"uploadTimeout", c.UploadTimeout},
+		{"gatewayTimeout", c.GatewayTimeout},
+	} {
+		if d.value.Duration <= 0 {
+			errs = append(errs, fmt.Errorf("%s: must be positive (got %v)", d.name, d.value))
+		}
+	}
+	if c.MaxUploadSize <= 0 {
+		errs = append(errs, fmt.Errorf("maxUploadSize: must be positive (got %d)", c.MaxUploadSize))
+	}
+	if c.MaxGatewayResponseSize <= 0 {
+		errs = append(errs, fmt.Errorf("maxGatewayResponseSize: must be positive (got %d)", c.MaxGatewayResponseSize))
+	}
+	switch c.AccessLog.Format {
+	case AccessLogText, AccessLogJSON, AccessLogCommon:
+	default:
+		errs = append(errs, fmt.Errorf("accessLog.format: must be text, json or common (got %q)", c.AccessLog.Format))
+	}
+	if c.MetricsAddr != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsAddr); err != nil {
+			errs = append(errs, fmt.Errorf("metricsAddr: %w", err))
+		}
+	}
+	if c.MaxConnections < 0 {
+		errs = append(errs, fmt.Errorf("maxConnections: must not be negative (got %d)", c.MaxConnections))
+	}
+	for _, l := range []struct {
+		name  string
+		value RateLimit
+	}{
+		{"static", c.RateLimits.Static},
+		{"search", c.RateLimits.Search},
+		{"dynamic", c.RateLimits.Dynamic},
+	} {
+		if l.value.Rate < 0 {
+			errs = append(errs, fmt.Errorf("rateLimits.%s.rate: must not be negative (got %v)", l.name, l.value.Rate))
+		}
+		if l.value.Rate > 0 && l.value.Burst < 1 {
+			errs = append(errs, fmt.Errorf("rateLimits.%s.burst: must be positive (got %d)", l.name, l.value.Burst))
+		}
+	}
+	if c.CertReloadInterval.Duration < 0 {
+		errs = append(errs, fmt.Errorf("certReloadInterval: must not be negative (got %v)", c.CertReloadInterval))
+	}
+	for i, d := range c.CertExpiryWarnings {
+		if d.Duration <= 0 {
+			errs = append(errs, fmt.Errorf("certExpiryWarnings[%d]: must be positive (got %v)", i, d))
+		}
+	}
+	errs = append(errs, c.HostConfig.validate()...)
+	names := map[string]bool{}
+	for _, n := range c.HostNames {
+		names[strings.ToLower(n)] = true
+	}
+	for i, h := range c.Hosts {
+		var herrs []error
+		if len(h.HostNames) == 0 {
+			herrs = append(herrs, fmt.Errorf("hostNames: must not be empty"))
+		}
+		if h.ContentDir == "" {
+			herrs = append(herrs, fmt.Errorf("contentDir: must not be empty"))
+		}
+		for _, n := range h.HostNames {
+			if names[strings.ToLower(n)] {
+				herrs = append(herrs, fmt.Errorf("hostNames: %s is served by multiple capsules", n))
+			}
+			names[strings.ToLower(n)] = true
+		}
+		for _, err := range append(herrs, h.validate()...) {
+			errs = append(errs, fmt.Errorf("hosts[%d].%w", i, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+func (c *HostConfig) validate() []error {
+	var errs []error
+	for _, p := range c.Listings {
+		if !strings.HasPrefix(p, "/") || !strings.HasSuffix(p, "/") {
+			errs = append(errs, fmt.Errorf("listings: invalid directory %q", p))
+		}
+	}
+	for _, p := range c.AdminPaths {
+		if !strings.HasPrefix(p, "/") || !strings.HasSuffix(p, "/") || p == "/" || p == "/_admin/" {
+			errs = append(errs, fmt.Errorf("adminPaths: invalid path prefix %q", p))
+		}
+	}
+	for i, g := range c.Gateways {
+		if !strings.HasPrefix(g.Prefix, "/") || !strings.HasSuffix(g.Prefix, "/") || g.Prefix == "/" || g.Prefix == "/_admin/" {
+			errs = append(errs, fmt.Errorf("gateways[%d].prefix: invalid path prefix %q", i, g.Prefix))
+		} else if slices.Contains(c.AdminPaths, g.Prefix) {
+			errs = append(errs, fmt.Errorf("gateways[%d].prefix: %q is also an admin path", i, g.Prefix))
+		}
+		if (g.CGIDir == "") == (g.SCGIAddr == "") {
+			errs = append(errs, fmt.Errorf("gateways[%d]: exactly one of cgiDir and scgiAddr must be specified", i))
+		}
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("certFile, keyFile: must be specified together"))
+	}
+	if c.MastodonID != "" {
+		if c.MastodonHost == "" {
+			errs = append(errs, fmt.Errorf("mastodonHost: required when mastodonID is set"))
+		}
+		if c.MastodonFetchInterval.Duration <= 0 {
+			errs = append(errs, fmt.Errorf("mastodonFetchInterval: must be positive (got %v)", c.MastodonFetchInterval))
+		}
+	}
+	if _, err := regexp.Compile(c.LocalURLPattern); err != nil {
+		errs = append(errs, fmt.Errorf("localURLPattern: %w", err))
+	}
+	return errs
+}
+
+// Uses the build output in the working directory for the files that are not
+// configured explicitly
+func (c *HostConfig) useWorkingDir() {
+	if c.ContentDir == "" {
+		c.ContentDir = "gemsite"
+		if c.SearchIndexFile == "" {
+			c.SearchIndexFile = "search.idx"
+		}
+		if c.RedirectsFile == "" {
+			c.RedirectsFile = "redirects.idx"
+		}
+	}
+	if c.TemplateDir == "" {
+		c.TemplateDir = "templates"
+	}
+}
+
+// A time.Duration that is represented as a string (e.g. "1h30m") in
+// configuration files and flags
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	return d.Set(string(b))
+}
+
+// Implements flag.Value
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
@@ -0,0 +1,197 @@
+package gemsite
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Gateways to CGI executables and SCGI servers
+// CGI: https://datatracker.ietf.org/doc/html/rfc3875
+// SCGI: https://python.ca/scgi/protocol.txt
+
+// Serves the paths under a prefix using a CGI executable or an SCGI server.
+// The gateway is expected to produce a complete Gemini response (header and
+// body).
+type gateway struct {
+	config GatewayConfig
+
+	// Port of the server, for requests without an explicit port
+	port string
+
+	// Time allowed to produce the complete response
+	timeout time.Duration
+
+	// Maximum size of the response body, in bytes
+	maxSize int64
+}
+
+func (g *gateway) ServeGemini(w ResponseWriter, r *Request) {
+	rest := strings.TrimPrefix(r.URL.Path, g.config.Prefix)
+	if g.config.SCGIAddr != "" {
+		g.serveSCGI(w, r, g.environ(r, strings.TrimSuffix(g.config.Prefix, "/"), "/"+rest))
+		return
+	}
+	name, pathInfo, found := strings.Cut(rest, "/")
+	if found {
+		pathInfo = "/" + pathInfo
+	}
+	if name == "" || strings.HasPrefix(name, ".") {
+		Error(w, StatusNotFound, "")
+		return
+	}
+	script := filepath.Join(g.config.CGIDir, name)
+	if fi, err := os.Stat(script); err != nil || !fi.Mode().IsRegular() || fi.Mode()&0111 == 0 {
+		Error(w, StatusNotFound, "")
+		return
+	}
+	g.serveCGI(w, script, g.environ(r, g.config.Prefix+name, pathInfo))
+}
+
+// Runs a CGI executable, and relays its response
+func (g *gateway) serveCGI(w ResponseWriter, script string, env []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), g.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, script)
+	cmd.Dir = filepath.Dir(script)
+	cmd.Env = append(env, "PATH="+os.Getenv("PATH"))
+	cmd.Stderr = os.Stderr
+
+	// Children of the script may keep its output open after it is killed, so
+	// the output is closed when the timeout expires.
+	stdout, pw, err := os.Pipe()
+	if err != nil {
+		log.Printf("%s: error creating pipe: %v", script, err)
+		Error(w, StatusCGIError, "")
+		return
+	}
+	defer stdout.Close()
+	stop := context.AfterFunc(ctx, func() { stdout.Close() })
+	defer stop()
+	cmd.Stdout = pw
+	err = cmd.Start()
+	pw.Close()
+	if err != nil {
+		log.Printf("%s: error starting CGI script: %v", script, err)
+		Error(w, StatusCGIError, "")
+		return
+	}
+	if err := g.relay(w, stdout); err != nil {
+		log.Printf("%s: %v", script, err)
+	}
+	// Output that was not relayed is discarded
+	stdout.Close()
+	if err := cmd.Wait(); err != nil {
+		log.Printf("%s: %v", script, err)
+	}
+}
+
+// Sends the request to an SCGI server, and relays its response
+func (g *gateway) serveSCGI(w ResponseWriter, r *Request, env []string) {
+	network := "tcp"
+	if strings.HasPrefix(g.config.SCGIAddr, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, g.config.SCGIAddr, g.timeout)
+	if err != nil {
+		log.Printf("%s: error connecting to SCGI server: %v", g.config.SCGIAddr, err)
+		Error(w, StatusCGIError, "")
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(g.timeout))
+
+	// The headers form a netstring, starting with CONTENT_LENGTH
+	var headers bytes.Buffer
+	headers.WriteString("CONTENT_LENGTH\x000\x00SCGI\x001\x00")
+	for _, e := range env {
+		k, v, _ := strings.Cut(e, "=")
+		headers.WriteString(k)
+		headers.WriteByte(0)
+		headers.WriteString(v)
+		headers.WriteByte(0)
+	}
+	if _, err := fmt.Fprintf(conn, "%d:%s,", headers.Len(), headers.Bytes()); err != nil {
+		log.Printf("%s: error sending SCGI request: %v", g.config.SCGIAddr, err)
+		Error(w, StatusCGIError, "")
+		return
+	}
+	if err := g.relay(w, conn); err != nil {
+		log.Printf("%s: %v", g.config.SCGIAddr, err)
+	}
+}
+
+// Returns the CGI meta-variables of a request
+func (g *gateway) environ(r *Request, scriptName string, pathInfo string) []string {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr.String())
+	port := r.URL.Port()
+	if port == "" {
+		port = g.port
+	}
+	env := []string{
+		"GATEWAY_INTERFACE=CGI/1.1",
+		"SERVER_PROTOCOL=GEMINI",
+		"SERVER_SOFTWARE=gemsite",
+		"SERVER_NAME=" + r.URL.Hostname(),
+		"SERVER_PORT=" + port,
+		"GEMINI_URL=" + r.URL.String(),
+		"SCRIPT_NAME=" + scriptName,
+		"PATH_INFO=" + pathInfo,
+		"QUERY_STRING=" + r.URL.RawQuery,
+		"REMOTE_ADDR=" + host,
+		"REMOTE_HOST=" + host,
+	}
+	if r.Certificate != nil {
+		env = append(env,
+			"AUTH_TYPE=Certificate",
+			"REMOTE_USER="+r.Certificate.Subject.CommonName,
+			"TLS_CLIENT_HASH=SHA256:"+fingerprint(r.Certificate),
+			"TLS_CLIENT_SUBJECT="+r.Certificate.Subject.String(),
+		)
+	}
+	return env
+}
+
+// Relays the response of a gateway to the client.
+// Responds with a 42 if the gateway did not produce a valid header.
+// Returns an error if the response was invalid, or the body was truncated
+// because it exceeded the maximum size.
+func (g *gateway) relay(w ResponseWriter, out io.Reader) error {
+	br := bufio.NewReaderSize(out, MaxMetaLength+8)
+	line, err := br.ReadSlice('\n')
+	if err != nil {
+		Error(w, StatusCGIError, "")
+		return fmt.Errorf("error reading response header: %w", err)
+	}
+	header := strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r")
+	code, meta, _ := strings.Cut(header, " ")
+	status, err := strconv.Atoi(code)
+	if err != nil || len(code) != 2 || status < 10 {
+		Error(w, StatusCGIError, "")
+		return fmt.Errorf("invalid response header: %q", header)
+	}
+	w.WriteHeader(status, meta)
+	if status != StatusSuccess {
+		return nil
+	}
+	n, err := io.Copy(w, io.LimitReader(br, g.maxSize))
+	if err != nil {
+		return fmt.Errorf("error relaying response: %w", err)
+	}
+	if n == g.maxSize {
+		if _, err := br.ReadByte(); err == nil {
+			return fmt.Errorf("response truncated at %d bytes", g.maxSize)
+		}
+	}
+	return nil
+}
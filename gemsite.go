@@ -2,260 +2,1138 @@ package gemsite
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
+	"log/slog"
 	"mime"
 	"net"
 	"net/http"
-	"net/textproto"
 	"net/url"
+	"os"
+	"os/signal"
+	pathpkg "path"
 	"path/filepath"
 	"regexp"
-	"runtime/debug"
-	"runtime/pprof"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
-	"text/template"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/remko/gemsite/internal/searchindex"
+	"github.com/remko/gemsite/internal/tokenizer"
 )
 
 ////////////////////////////////////////////////////////////////////////////////
 // Server
 ////////////////////////////////////////////////////////////////////////////////
 
+// Returned by ListenAndServe after a call to Shutdown
+var ErrServerClosed = errors.New("gemsite: server closed")
+
+type Server struct {
+	config Config
+	port   string
+
+	// Additional capsules first, default capsule last
+	capsules       []*capsule
+	defaultCapsule *capsule
+
+	accessLog     *slog.Logger
+	accessLogFile *logFile
+	metrics       *metrics
+
+	// Built-in administration pages
+	admin []adminRoute
+
+	// Rate limiters, by route class. Classes without limit are absent.
+	limiters map[string]*rateLimiter
+
+	allowlist *allowlist
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+	closing  bool
+	done     chan struct{}
+}
+
+// Listens on the given address, using the default configuration
 func Listen(laddr string) error {
-	// Initialization
-	mime.AddExtensionType(".gmi", "text/gemini")
-	var err error
-	content, err = fs.Sub(assets, "gemsite")
+	config := DefaultConfig()
+	config.Addr = laddr
+	return ListenWithConfig(config)
+}
+
+func ListenWithConfig(config Config) error {
+	s, err := NewServer(config)
 	if err != nil {
 		return err
 	}
+	return s.ListenAndServe()
+}
 
-	// Load search index
-	if err := loadSearchIndex(); err != nil {
-		return err
+// Creates a server, loading all capsules
+func NewServer(config Config) (*Server, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	s := &Server{
+		config:  config,
+		conns:   map[net.Conn]struct{}{},
+		done:    make(chan struct{}),
+		metrics: newMetrics(),
+	}
+	_, s.port, _ = net.SplitHostPort(config.Addr)
+	s.admin = s.adminRoutes()
+	if config.Dev {
+		config.HostConfig.useWorkingDir()
+		s.config = config
+	}
+
+	var err error
+	if s.accessLog, s.accessLogFile, err = newAccessLogger(config.AccessLog); err != nil {
+		return nil, err
 	}
 
-	// TLS setup
-	cert, err := tls.X509KeyPair(servercert, serverkey)
+	s.allowlist = &allowlist{path: config.AllowlistFile}
+	if config.AllowlistFile != "" {
+		if err := s.allowlist.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	s.limiters = map[string]*rateLimiter{}
+	for class, limit := range map[string]RateLimit{
+		routeStatic:  config.RateLimits.Static,
+		routeSearch:  config.RateLimits.Search,
+		routeDynamic: config.RateLimits.Dynamic,
+	} {
+		if limit.Rate > 0 {
+			s.limiters[class] = newRateLimiter(limit)
+		}
+	}
+
+	// Load capsules
+	s.defaultCapsule, err = newCapsule(config.HostConfig, nil)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	for _, hc := range config.Hosts {
+		c, err := newCapsule(hc, s.defaultCapsule.certs)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", strings.Join(hc.HostNames, ","), err)
+		}
+		s.capsules = append(s.capsules, c)
 	}
-	clientCertCAs := x509.NewCertPool()
-	if ok := clientCertCAs.AppendCertsFromPEM(servercert); !ok {
-		return fmt.Errorf("unable to add client ca cert")
+	s.capsules = append(s.capsules, s.defaultCapsule)
+	for _, c := range s.capsules {
+		s.registerRoutes(c)
+		log.Printf("serving %v", c)
 	}
+	return s, nil
+}
 
-	listen, err := tls.Listen("tcp", laddr,
-		&tls.Config{
-			Certificates: []tls.Certificate{cert},
-			ClientAuth:   tls.VerifyClientCertIfGiven,
-			ClientCAs:    clientCertCAs,
+// Listens on the configured address, and serves requests until Shutdown is
+// called.
+// Always returns a non-nil error; after Shutdown, the error is ErrServerClosed.
+func (s *Server) ListenAndServe() error {
+	listen, err := tls.Listen("tcp", s.config.Addr, &tls.Config{
+		// Select the certificates based on SNI, falling back to the default
+		// capsule's certificates for unknown names
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			c := s.capsuleForHost(hello.ServerName)
+			if c == nil {
+				c = s.defaultCapsule
+			}
+			return c.certs.current(), nil
 		},
-	)
+	})
 	if err != nil {
 		return err
 	}
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		listen.Close()
+		return ErrServerClosed
+	}
+	s.listener = listen
+	s.mu.Unlock()
 	defer listen.Close()
-	log.Printf("listening on %s", laddr)
+	log.Printf("listening on %s", s.config.Addr)
+
+	if s.config.MetricsAddr != "" {
+		go s.listenMetrics()
+	}
+
+	// Certificate reloading and monitoring
+	go s.monitorCertificates()
+	go s.reloadOnSignal()
+	if s.config.CertReloadInterval.Duration > 0 {
+		go s.reloadOnChange()
+	}
 
 	// Accept connections
+	var delay time.Duration
 	for {
 		conn, err := listen.Accept()
 		if err != nil {
-			log.Printf("error accepting connection: %v", err)
+			if s.isClosing() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+
+			// Back off, to avoid spinning on persistent errors (e.g. running out
+			// of file descriptors)
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			log.Printf("error accepting connection: %v; retrying in %v", err, delay)
+			select {
+			case <-time.After(delay):
+			case <-s.done:
+			}
+			continue
+		}
+		delay = 0
+		if !s.trackConn(conn) {
+			conn.Close()
 			continue
 		}
-		go handleRequest(conn)
+		go func() {
+			defer s.untrackConn(conn)
+			s.handleRequest(conn)
+		}()
+	}
+}
+
+// Stops accepting connections, and waits for open connections to finish.
+// If the context expires before all connections are finished, the remaining
+// connections are closed, and the context's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closing {
+		s.closing = true
+		close(s.done)
+		if s.listener != nil {
+			s.listener.Close()
+		}
+	}
+	log.Printf("shutting down; waiting for %d connections", len(s.conns))
+	s.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		log.Printf("shutdown deadline expired; closing %d connections", len(s.conns))
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (s *Server) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// Registers an open connection.
+// Returns false if the server is shutting down, or has the maximum number of
+// open connections.
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	if s.config.MaxConnections > 0 && len(s.conns) >= s.config.MaxConnections {
+		log.Printf("%s: refusing connection: %d connections open", conn.RemoteAddr(), len(s.conns))
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+	s.wg.Done()
+}
+
+// Returns the capsule serving the given host name, or nil if there is none
+func (s *Server) capsuleForHost(host string) *capsule {
+	for _, c := range s.capsules {
+		if c.serves(host) {
+			return c
+		}
+	}
+	return nil
+}
+
+// Returns the distinct certificates of all capsules
+func (s *Server) certificates() []*certificates {
+	var result []*certificates
+	for _, c := range s.capsules {
+		if !slices.Contains(result, c.certs) {
+			result = append(result, c.certs)
+		}
+	}
+	return result
+}
+
+// Reloads the certificates and the allowlist when receiving a SIGHUP
+func (s *Server) reloadOnSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-hup:
+			log.Printf("received SIGHUP; reloading certificates")
+			for _, certs := range s.certificates() {
+				if err := certs.load(); err != nil {
+					log.Printf("error reloading certificates: %v", err)
+				}
+			}
+			if s.config.AllowlistFile != "" {
+				if err := s.allowlist.load(); err != nil {
+					log.Printf("error reloading allowlist: %v", err)
+				}
+			}
+			if s.accessLogFile != nil {
+				if err := s.accessLogFile.reopen(); err != nil {
+					log.Printf("error reopening access log: %v", err)
+				}
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Periodically reloads the certificates and the allowlist if they changed on
+// disk
+func (s *Server) reloadOnChange() {
+	ticker := time.NewTicker(s.config.CertReloadInterval.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, certs := range s.certificates() {
+				if err := certs.reloadIfChanged(); err != nil {
+					log.Printf("error reloading certificates: %v", err)
+				}
+			}
+			if s.config.AllowlistFile != "" {
+				if err := s.allowlist.reloadIfChanged(); err != nil {
+					log.Printf("error reloading allowlist: %v", err)
+				}
+			}
+		case <-s.done:
+			return
+		}
 	}
 }
 
+// Maximum length of a request URL, excluding the terminating CRLF
+const MaxRequestLength = 1024
+
 // Request handler
 // Protocol: https://geminiprotocol.net/docs/specification.gmi
-func handleRequest(conn net.Conn) {
+func (s *Server) handleRequest(conn net.Conn) {
 	start := time.Now()
 	defer conn.Close()
 
-	tp := textproto.NewConn(conn)
-
+	resp := newResponse(conn)
+	w := &statusWriter{ResponseWriter: resp}
+	var line string
+	var uri *url.URL
 	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("panic: %v\n%s", r, string(debug.Stack()))
-			tp.PrintfLine("40")
+		if err := resp.flush(); err != nil {
+			log.Printf("%s: error sending response: %v", conn.RemoteAddr(), err)
+		}
+		if w.status != 0 {
+			duration := time.Since(start)
+			s.logRequest(conn, line, w, duration)
+			path := ""
+			if uri != nil {
+				path = uri.Path
+			}
+			s.metrics.request(path, w.status, w.size, duration)
 		}
 	}()
 
-	line, err := tp.ReadLine()
-	defer func() {
-		log.Printf("%s %s (%v)", conn.RemoteAddr(), line, time.Since(start))
-	}()
+	line, body, err := s.readRequestLine(conn, start)
 	if err != nil {
-		log.Printf("error reading request: %v", err)
+		log.Printf("%s: rejecting request: %v", conn.RemoteAddr(), err)
+		if rerr, ok := err.(requestError); ok {
+			Error(w, StatusBadRequest, string(rerr))
+		}
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout.Duration))
+
+	uri, err = url.Parse(line)
+	if err != nil {
+		log.Printf("%s: error parsing url: %v", conn.RemoteAddr(), err)
+		Error(w, StatusBadRequest, "Invalid URL")
+		return
+	}
+	if !uri.IsAbs() || uri.Host == "" {
+		log.Printf("%s: rejecting request: not an absolute URL: %s", conn.RemoteAddr(), line)
+		Error(w, StatusBadRequest, "Absolute URL required")
+		return
+	}
+	if !validPath(uri) {
+		log.Printf("%s: rejecting request: invalid path: %s", conn.RemoteAddr(), line)
+		Error(w, StatusBadRequest, "Invalid path")
 		return
 	}
 
-	uri, err := url.Parse(line)
+	// Virtual hosting
+	cstate := conn.(*tls.Conn).ConnectionState()
+	c, err := s.capsuleFor(uri, cstate.ServerName)
 	if err != nil {
-		log.Printf("error parsing url: %v", err)
-		tp.PrintfLine("59")
+		log.Printf("%s: refusing request: %v", conn.RemoteAddr(), err)
+		Error(w, StatusProxyRequestRefused, "Proxy request refused: "+err.Error())
 		return
 	}
 
-	// Admin auth
-	if strings.HasPrefix(uri.Path, "/_admin") {
-		cstate := conn.(*tls.Conn).ConnectionState()
-		if len(cstate.PeerCertificates) == 0 {
-			tp.PrintfLine("60")
+	r := &Request{
+		URL:        uri,
+		RemoteAddr: conn.RemoteAddr(),
+		ServerName: cstate.ServerName,
+		clientCAs:  c.certs.clientCAPool(),
+	}
+	if len(cstate.PeerCertificates) > 0 {
+		r.Certificate = cstate.PeerCertificates[0]
+		r.intermediates = cstate.PeerCertificates[1:]
+	}
+	if uri.Scheme == "titan" {
+		conn.SetReadDeadline(time.Now().Add(s.config.UploadTimeout.Duration))
+		conn.SetWriteDeadline(time.Now().Add(s.config.UploadTimeout.Duration + s.config.WriteTimeout.Duration))
+		r.Body = body
+		c.uploadHandler.ServeGemini(w, r)
+		return
+	}
+	c.handler.ServeGemini(w, r)
+}
+
+// Registers the built-in routes of a capsule
+func (s *Server) registerRoutes(c *capsule) {
+	if s.config.Dev {
+		c.handler = Chain(c.mux, Recover, c.reloadOnChange)
+	} else {
+		c.handler = Chain(c.mux, Recover)
+	}
+	static, search, dynamic := s.rateLimit(routeStatic), s.rateLimit(routeSearch), s.rateLimit(routeDynamic)
+	c.mux.Handle("/search", search(c.searchHandler(SortRelevance)))
+	c.mux.Handle("/search/date", search(c.searchHandler(SortDate)))
+	c.mux.Handle("/ublog", dynamic(HandlerFunc(c.serveMicroblog)))
+	// Redirects are handled by the file routes, after authorization and rate
+	// limiting, so they don't reveal which protected pages exist
+	files := c.redirect(&fileHandler{fsys: c.content, lang: c.config.Lang, listing: c.listing})
+	c.mux.Handle("/_admin/", s.RequireAdmin(s.adminIndex(files)))
+	for _, route := range s.admin {
+		c.mux.Handle(route.path, s.RequireAdmin(route.handler))
+	}
+	c.mux.Handle("/_admin/allowlist/set", s.RequireAdmin(HandlerFunc(s.serveAllowlistSet)))
+	c.mux.Handle("/_admin/allowlist/remove", s.RequireAdmin(HandlerFunc(s.serveAllowlistRemove)))
+	c.metrics = s.metrics
+	for _, p := range c.config.AdminPaths {
+		c.mux.Handle(p, s.RequireRole(RoleViewer)(files))
+	}
+	for _, g := range c.config.Gateways {
+		c.mux.Handle(g.Prefix, dynamic(&gateway{
+			config:  g,
+			port:    s.port,
+			timeout: s.config.GatewayTimeout.Duration,
+			maxSize: s.config.MaxGatewayResponseSize,
+		}))
+	}
+	c.mux.Handle("/", static(files))
+	if c.uploads != nil {
+		c.uploads.maxSize = s.config.MaxUploadSize
+		c.uploadHandler = Chain(HandlerFunc(c.serveUpload), Recover, s.RequireRole(RoleEditor))
+	}
+}
+
+// Registers a handler for the given pattern on all capsules.
+// Must be called before ListenAndServe.
+func (s *Server) Handle(pattern string, handler Handler) {
+	for _, c := range s.capsules {
+		c.mux.Handle(pattern, handler)
+	}
+}
+
+func (s *Server) HandleFunc(pattern string, handler func(ResponseWriter, *Request)) {
+	s.Handle(pattern, HandlerFunc(handler))
+}
+
+// Returns the capsule for a request URL on a connection with the given SNI
+// name.
+// Returns an error if the request is for a host or port that is not served,
+// which should be answered with a 53.
+func (s *Server) capsuleFor(uri *url.URL, sni string) (*capsule, error) {
+	if uri.Scheme != "gemini" && uri.Scheme != "titan" {
+		return nil, fmt.Errorf("unsupported scheme: %s", uri.Scheme)
+	}
+	if port := uri.Port(); port != "" && port != s.port {
+		return nil, fmt.Errorf("unsupported port: %s", port)
+	}
+	c := s.capsuleForHost(uri.Hostname())
+	if c == nil {
+		return nil, fmt.Errorf("unknown host: %s", uri.Hostname())
+	}
+	if uri.Scheme == "titan" && c.uploads == nil {
+		return nil, fmt.Errorf("uploads not enabled for host: %s", uri.Hostname())
+	}
+	if sni != "" && s.capsuleForHost(sni) != c {
+		return nil, fmt.Errorf("host %s does not match SNI %s", uri.Hostname(), sni)
+	}
+	return c, nil
+}
+
+// A malformed request, which should be answered with a 59
+type requestError string
+
+func (e requestError) Error() string {
+	return string(e)
+}
+
+// Reads the request line, enforcing the idle and read deadlines, the maximum
+// request length, and CRLF termination.
+// Returns a requestError if the client sent a malformed request, and another
+// error if the request could not be read.
+// The returned reader yields the data following the request line.
+func (s *Server) readRequestLine(conn net.Conn, start time.Time) (string, io.Reader, error) {
+	conn.SetDeadline(start.Add(s.config.IdleTimeout.Duration))
+	r := bufio.NewReaderSize(conn, MaxRequestLength+2)
+	if _, err := r.Peek(1); err != nil {
+		return "", nil, fmt.Errorf("error waiting for request: %w", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(s.config.ReadTimeout.Duration))
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", nil, requestError(fmt.Sprintf("request exceeds %d bytes", MaxRequestLength))
+	} else if err == io.EOF {
+		return "", nil, requestError("request not terminated by CRLF")
+	} else if err != nil {
+		return "", nil, fmt.Errorf("error reading request: %w", err)
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", nil, requestError("request not terminated by CRLF")
+	}
+	if len(line) == 2 {
+		return "", nil, requestError("empty request")
+	}
+	return string(line[:len(line)-2]), r, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Static files
+////////////////////////////////////////////////////////////////////////////////
+
+// Returns a handler serving the files from the given file system.
+// Directories are served by their index.gmi file.
+func FileServer(fsys fs.FS) Handler {
+	return &fileHandler{fsys: fsys}
+}
+
+type fileHandler struct {
+	fsys fs.FS
+
+	// Language of the gemtext files
+	lang string
+
+	// Returns whether a listing should be generated for a directory without an
+	// index.gmi file
+	listing func(dir string) bool
+}
+
+func (h *fileHandler) ServeGemini(w ResponseWriter, r *Request) {
+	path := r.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	name, isDir, err := resolvePath(h.fsys, path)
+	if err != nil {
+		FileError(w, err)
+		return
+	}
+	if isDir {
+		if !strings.HasSuffix(path, "/") {
+			// Relative, so it also works when the path has a stripped prefix
+			Redirect(w, pathpkg.Base(path)+"/", StatusRedirectPermanent)
 			return
 		}
-		cert := cstate.PeerCertificates[0]
-		if !strings.HasPrefix(cert.Subject.CommonName, "admin@") {
-			tp.PrintfLine("61")
+		index := pathpkg.Join(name, "index.gmi")
+		if _, err := fs.Stat(h.fsys, index); errors.Is(err, fs.ErrNotExist) {
+			if h.listing == nil || !h.listing(path) {
+				Error(w, StatusNotFound, "")
+				return
+			}
+			h.serveListing(w, name, path)
 			return
 		}
+		name = index
+	}
+	f, err := h.fsys.Open(name)
+	if err != nil {
+		FileError(w, err)
+		return
 	}
+	defer f.Close()
+	w.WriteHeader(StatusSuccess, fileType(name, h.lang))
+	_, err = io.Copy(w, f)
+	if err != nil {
+		log.Printf("error sending response: %v", err)
+	}
+}
 
-	// Handle dynamic paths
-	path := uri.Path
-	switch path {
-	case "/search":
-		search, err := url.QueryUnescape(uri.RawQuery)
-		if err != nil {
-			log.Printf("invalid search query: %v", err)
-			tp.PrintfLine("59")
-		} else if len(search) == 0 {
-			tp.PrintfLine("10 Search:")
+// Responds with a gemtext listing of the entries of a directory
+func (h *fileHandler) serveListing(w ResponseWriter, name string, path string) {
+	entries, err := fs.ReadDir(h.fsys, name)
+	if err != nil {
+		FileError(w, err)
+		return
+	}
+	w.WriteHeader(StatusSuccess, gemtextType(h.lang))
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	fmt.Fprintf(bw, "# Index of %s\n\n", path)
+	if path != "/" {
+		fmt.Fprintf(bw, "=> ../ ⬆ Parent directory\n")
+	}
+	for _, e := range entries {
+		ename := e.Name()
+		if strings.HasPrefix(ename, ".") || strings.HasPrefix(ename, "_") {
+			continue
+		}
+		if e.IsDir() {
+			ename += "/"
 		} else {
-			tp.PrintfLine("20 text/gemini")
-			query := strings.Fields(search)
-			pages := searchPages(query)
-			if err := searchTemplate.Execute(conn, SearchTemplateContext{Query: strings.Join(query, " "), Pages: pages}); err != nil {
-				log.Printf("error rendering: %v", err)
-				return
-			}
+			ename = strings.TrimSuffix(ename, ".gmi")
 		}
-		return
+		fmt.Fprintf(bw, "=> %s %s\n", (&url.URL{Path: ename}).EscapedPath(), ename)
+	}
+}
 
-	case "/ublog":
-		statuses, err := fetchStatuses()
+// Resolves a URL path to the name of a file or directory in the file system.
+// Paths without an extension map to the corresponding .gmi file, if it exists.
+// Paths ending with a slash only map to directories.
+func resolvePath(fsys fs.FS, path string) (name string, isDir bool, err error) {
+	if !strings.HasPrefix(path, "/") {
+		return "", false, fs.ErrInvalid
+	}
+	name = strings.Trim(path, "/")
+	if name == "" {
+		name = "."
+	}
+	if strings.HasSuffix(path, "/") {
+		fi, err := fs.Stat(fsys, name)
 		if err != nil {
-			log.Printf("error fetching statuses: %v", err)
-			tp.PrintfLine("42")
-			return
+			return "", false, err
 		}
+		if !fi.IsDir() {
+			return "", false, fs.ErrNotExist
+		}
+		return name, true, nil
+	}
+	if fi, err := fs.Stat(fsys, name+".gmi"); err == nil && !fi.IsDir() {
+		return name + ".gmi", false, nil
+	}
+	fi, err := fs.Stat(fsys, name)
+	if err != nil {
+		return "", false, err
+	}
+	return name, fi.IsDir(), nil
+}
 
-		tp.PrintfLine("20 text/gemini")
-		if err := ublogTemplate.Execute(conn, UBlogTemplateContext{Statuses: statuses}); err != nil {
-			log.Printf("error rendering: %v", err)
-			return
+// Checks that a request path has no dot segments, and no encoded slashes,
+// backslashes or NUL characters, which could be used to escape the served tree
+func validPath(u *url.URL) bool {
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment == "." || segment == ".." {
+			return false
 		}
+	}
+	if strings.ContainsAny(u.Path, "\\\x00") {
+		return false
+	}
+	epath := strings.ToLower(u.EscapedPath())
+	return !strings.Contains(epath, "%2f") && !strings.Contains(epath, "%5c")
+}
+
+// Responds with the status corresponding to an error opening or reading a
+// file: a 51 for files that don't exist, and a 40 for other errors
+func FileError(w ResponseWriter, err error) {
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) {
+		Error(w, StatusNotFound, "")
 		return
+	}
+	log.Printf("error opening file: %v", err)
+	Error(w, StatusTemporaryFailure, "Unable to read file")
+}
 
-	case "/_admin/pprof/profile":
-		tp.PrintfLine("20 application/octet-stream")
-		if err := pprof.StartCPUProfile(conn); err != nil {
-			log.Printf("error collecting profile: %v", err)
-			return
+// Returns the MIME type of a file.
+// Gemtext files are annotated with the given language (if not empty).
+func fileType(path string, lang string) string {
+	ext := filepath.Ext(path)
+	if ext == ".gmi" || ext == ".gemini" {
+		return gemtextType(lang)
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// Returns the MIME type for gemtext in the given language (if not empty)
+func gemtextType(lang string) string {
+	if lang == "" {
+		return "text/gemini; charset=utf-8"
+	}
+	return "text/gemini; charset=utf-8; lang=" + lang
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Redirects
+////////////////////////////////////////////////////////////////////////////////
+
+type redirect struct {
+	target string
+	status int
+}
+
+// Parses a redirects table, as generated by buildgemsite.
+// The table consists of lines of space-separated source path, target URL, and
+// status.
+func loadRedirects(table string) (map[string]redirect, error) {
+	redirects := map[string]redirect{}
+	s := bufio.NewScanner(strings.NewReader(table))
+	for n := 1; s.Scan(); n++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 {
+			continue
 		}
-		time.Sleep(20 * time.Second)
-		pprof.StopCPUProfile()
-		return
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("redirects:%d: invalid entry", n)
+		}
+		status, err := strconv.Atoi(fields[2])
+		if err != nil || (status != StatusRedirectTemporary && status != StatusRedirectPermanent) {
+			return nil, fmt.Errorf("redirects:%d: invalid status: %s", n, fields[2])
+		}
+		redirects[fields[0]] = redirect{target: fields[1], status: status}
 	}
+	return redirects, s.Err()
+}
 
-	// Serve static file
-	fp := pathToFile(path)
-	f, err := content.Open(fp)
-	if err != nil {
-		log.Printf("error opening file: %v", err)
-		tp.PrintfLine("51")
-		return
+// Redirects requests for paths in the redirects table, and requests for
+// non-canonical paths of existing pages (e.g. "/blog/", "/index", or
+// "/blog/post.gmi")
+func (c *capsule) redirect(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		path := r.URL.Path
+		if rd, ok := c.redirects[path]; ok {
+			Redirect(w, withQuery(rd.target, r.URL), rd.status)
+			return
+		}
+		if cpath := c.canonicalPath(path); cpath != path {
+			Redirect(w, withQuery(cpath, r.URL), StatusRedirectPermanent)
+			return
+		}
+		next.ServeGemini(w, r)
+	})
+}
+
+// Returns the canonical path of a page, without gemtext extension or "index",
+// and with a trailing slash only for directories.
+// Returns the path unchanged if there is no such page.
+func (c *capsule) canonicalPath(path string) string {
+	cpath := strings.TrimSuffix(path, ".gmi")
+	if cpath == "/index" || strings.HasSuffix(cpath, "/index") {
+		cpath = cpath[:len(cpath)-len("index")]
+	}
+	cpath = strings.TrimRight(cpath, "/")
+	if cpath == "" {
+		return "/"
 	}
-	tp.PrintfLine("20 %s", mime.TypeByExtension(filepath.Ext(fp)))
-	_, err = io.Copy(conn, f)
+	_, isDir, err := resolvePath(c.content, cpath)
 	if err != nil {
-		log.Printf("error sending response: %v", err)
+		return path
+	}
+	if isDir {
+		return cpath + "/"
 	}
+	return cpath
+}
+
+// Checks whether there is a page or directory for the given path
+func (c *capsule) exists(path string) bool {
+	_, _, err := resolvePath(c.content, path)
+	return err == nil
+}
+
+// Adds the query of the request URL to a redirect target that has none
+func withQuery(target string, u *url.URL) string {
+	if u.RawQuery == "" || strings.Contains(target, "?") {
+		return target
+	}
+	return target + "?" + u.RawQuery
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 // Search
 ////////////////////////////////////////////////////////////////////////////////
 
-const MinSearchWordLength = 3
+// Minimum length of words to search for
+const MinSearchWordLength = tokenizer.MinWordLength
 
 type Page struct {
-	Path  string
-	Date  string
-	Title string
+	Path     string
+	Date     string
+	Title    string
+	Featured bool
+	Tags     []string
+
+	// Number of indexed words
+	length int
+
+	// Terms of the title, with empty terms for words that are not indexed
+	titleTokens []string
+
+	// Text of the page, to show snippets from
+	text string
 }
 
-var searchIndex map[string]map[*Page]struct{}
-
-// Loads the search index from disk
-// The search index consists of lines of null-separated strings
-func loadSearchIndex() error {
-	searchIndex = map[string]map[*Page]struct{}{}
-	sis := bufio.NewScanner(strings.NewReader(searchidx))
-	sis.Split(bufio.ScanLines)
-	for sis.Scan() {
-		entry := strings.Split(sis.Text(), "\x00")
-		page := Page{
-			Path:  entry[0],
-			Title: entry[1],
-			Date:  entry[2],
-		}
-		for _, word := range entry[3:] {
-			ps, ok := searchIndex[word]
-			if !ok {
-				ps = map[*Page]struct{}{}
+// A page matching a search query
+type SearchResult struct {
+	*Page
+
+	// Parts of the text around the first match of each query word, with the
+	// matched words emphasized (e.g. "… uses the *secure* *enclave* …")
+	Snippet string
+}
+
+// Orders of search results
+const (
+	SortRelevance = "relevance"
+	SortDate      = "date"
+)
+
+// Returns a handler searching for the query, with results in the given order
+func (c *capsule) searchHandler(order string) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		search, err := url.QueryUnescape(r.URL.RawQuery)
+		if err != nil {
+			log.Printf("invalid search query: %v", err)
+			Error(w, StatusBadRequest, "Invalid search query")
+			return
+		} else if len(search) == 0 {
+			w.WriteHeader(StatusInput, "Search:")
+			return
+		}
+		w.WriteHeader(StatusSuccess, gemtextType(c.config.Lang))
+		c.metrics.search()
+		ctx := SearchTemplateContext{Query: strings.Join(strings.Fields(search), " "), Sort: order}
+		index := c.index()
+		if q, err := parseQuery(search, index.tokenizer); err != nil {
+			ctx.Error = err.Error()
+		} else {
+			ctx.Pages = index.search(q, order)
+			ctx.Ignored = q.ignored
+		}
+		if err := c.searchTemplate.Execute(w, ctx); err != nil {
+			log.Printf("error rendering: %v", err)
+		}
+	})
+}
+
+type searchIndex struct {
+	pages []*Page
+
+	// Turns words into terms, using the stop words the index was built with
+	tokenizer *tokenizer.Tokenizer
+
+	// Stop words of the index
+	stopWords []string
+
+	// The indexes the pages were loaded from
+	segments []indexSegment
+
+	// Average number of indexed words of a page
+	averageLength float64
+}
+
+// An index the search index was loaded from
+type indexSegment struct {
+	index *searchindex.Index
+
+	// Pages of the documents of the index, by document number. Nil for
+	// documents replaced by a later index.
+	pages []*Page
+}
+
+// Loads search indexes (see searchindex.Write).
+// Documents in later indexes replace the documents with the same path in
+// earlier indexes. The stop words of the first (non-empty) index are used.
+// The term dictionaries and postings are not decoded, but looked up in the
+// index data when searching.
+func loadSearchIndex(idxs ...[]byte) (*searchIndex, error) {
+	index := &searchIndex{}
+	locations := map[string][2]int{} // Segment and document of each path
+	totalLength := 0
+	for _, idx := range idxs {
+		if len(idx) == 0 {
+			continue
+		}
+		si, err := searchindex.Read(idx)
+		if err != nil {
+			return nil, err
+		}
+		if index.segments == nil {
+			index.stopWords = si.StopWords
+		}
+		segment := indexSegment{index: si, pages: make([]*Page, len(si.Docs))}
+		for i, doc := range si.Docs {
+			page := &Page{
+				Path:     doc.URL,
+				Title:    doc.Title,
+				Date:     doc.Date,
+				Featured: doc.Featured,
+				Tags:     doc.Tags,
+				length:   doc.Length,
+				text:     doc.Text,
+			}
+			segment.pages[i] = page
+			if l, ok := locations[doc.URL]; ok {
+				old := index.segments[l[0]].pages[l[1]]
+				index.segments[l[0]].pages[l[1]] = nil
+				index.pages[slices.Index(index.pages, old)] = page
+				totalLength -= old.length
+			} else {
+				index.pages = append(index.pages, page)
 			}
-			ps[&page] = struct{}{}
-			searchIndex[word] = ps
+			locations[doc.URL] = [2]int{len(index.segments), i}
+			totalLength += page.length
 		}
+		index.segments = append(index.segments, segment)
 	}
-	if err := sis.Err(); err != nil {
-		return err
+	if index.segments == nil {
+		index.stopWords = tokenizer.DefaultStopWords
 	}
-	return nil
+	index.tokenizer = tokenizer.New(index.stopWords)
+	for _, page := range index.pages {
+		page.titleTokens = index.tokenizer.Terms(page.Title)
+	}
+	if len(index.pages) > 0 {
+		index.averageLength = float64(totalLength) / float64(len(index.pages))
+	}
+	return index, nil
+}
+
+// Returns the pages containing a term, with the positions of the term in the
+// page
+func (index *searchIndex) postings(term string) map[*Page][]int {
+	result := map[*Page][]int{}
+	for _, segment := range index.segments {
+		for _, p := range segment.index.Postings(term) {
+			if page := segment.pages[p.Doc]; page != nil {
+				result[page] = p.Positions
+			}
+		}
+	}
+	return result
+}
+
+// Returns the indexed terms starting with a prefix, sorted
+func (index *searchIndex) terms(prefix string) []string {
+	var result []string
+	for _, segment := range index.segments {
+		result = append(result, segment.index.Terms(prefix)...)
+	}
+	slices.Sort(result)
+	return slices.Compact(result)
+}
+
+// Returns the pages matching the query, ranked by relevance (see
+// searchIndex.match), or by date (most recent first)
+func (index *searchIndex) search(q *searchQuery, order string) []SearchResult {
+	var scores map[*Page]float64
+	var highlights []string
+	for _, clause := range q.clauses {
+		matches := map[*Page]float64{}
+		for _, t := range clause {
+			for page, score := range index.match(t) {
+				matches[page] += score
+			}
+			highlights = append(highlights, index.highlights(t)...)
+		}
+		if scores == nil {
+			scores = matches
+			continue
+		}
+		for page, score := range scores {
+			if match, ok := matches[page]; ok {
+				scores[page] = score + match
+			} else {
+				delete(scores, page)
+			}
+		}
+	}
+	for _, t := range q.excluded {
+		for page := range index.match(t) {
+			delete(scores, page)
+		}
+	}
+
+	pages := make([]*Page, 0, len(scores))
+	for page := range scores {
+		pages = append(pages, page)
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		a, b := pages[i], pages[j]
+		if order == SortDate && a.Date != b.Date {
+			return a.Date > b.Date
+		}
+		if scores[a] != scores[b] {
+			return scores[a] > scores[b]
+		}
+		return a.Title < b.Title
+	})
+	result := make([]SearchResult, 0, len(pages))
+	for _, page := range pages {
+		result = append(result, SearchResult{Page: page, Snippet: snippet(page.text, highlights, index.tokenizer)})
+	}
+	return result
 }
 
-func searchPages(query []string) []*Page {
-	var pages map[*Page]struct{}
-	for _, q := range query {
-		if len(q) <= MinSearchWordLength {
+// Number of bytes of context shown on each side of a match in a snippet
+const snippetContext = 50
+
+// Maximum number of matches shown in a snippet
+const maxSnippetParts = 3
+
+// Returns the parts of the text around the first occurrence of each term (at
+// most maxSnippetParts), with all words with the terms in them emphasized.
+// Without occurrences, the start of the text is returned.
+func snippet(text string, terms []string, tok *tokenizer.Tokenizer) string {
+	type span struct{ start, end int }
+	var matches []span
+	first := map[string]bool{}
+	var parts []span
+	for _, m := range wordSpans(text) {
+		term := tok.Term(tokenizer.Fold(text[m[0]:m[1]]))
+		if term == "" || !slices.Contains(terms, term) {
+			continue
+		}
+		matches = append(matches, span{m[0], m[1]})
+		if first[term] {
 			continue
 		}
-		ps, ok := searchIndex[strings.ToLower(q)]
-		if !ok {
-			return []*Page{}
+		first[term] = true
+		part := span{m[0] - snippetContext, m[1] + snippetContext}
+		if len(parts) == maxSnippetParts && part.start > parts[len(parts)-1].end {
+			continue
 		}
-		if pages == nil {
-			pages = ps
+		if n := len(parts); n > 0 && part.start <= parts[n-1].end {
+			parts[n-1].end = part.end
 		} else {
-			npages := map[*Page]struct{}{}
-			for page := range pages {
-				if _, ok := ps[page]; ok {
-					npages[page] = struct{}{}
-				}
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		parts = []span{{0, 2 * snippetContext}}
+	}
+
+	var b strings.Builder
+	for _, part := range parts {
+		// Only show whole words, unless the context is a single word
+		start, end := max(part.start, 0), min(part.end, len(text))
+		if start > 0 && text[start-1] != ' ' {
+			if i := strings.IndexByte(text[start:], ' '); i >= 0 && start+i < part.start+snippetContext {
+				start += i + 1
+			}
+		}
+		if end < len(text) && text[end] != ' ' {
+			if i := strings.LastIndexByte(text[:end], ' '); i > part.end-snippetContext {
+				end = i
+			}
+		}
+		for start < len(text) && !utf8.RuneStart(text[start]) {
+			start++
+		}
+		for end < len(text) && !utf8.RuneStart(text[end]) {
+			end++
+		}
+		if start > 0 {
+			b.WriteString("… ")
+		}
+		pos := start
+		for _, m := range matches {
+			if m.start >= start && m.end <= end {
+				b.WriteString(text[pos:m.start])
+				b.WriteString("*" + text[m.start:m.end] + "*")
+				pos = m.end
 			}
-			pages = npages
 		}
+		b.WriteString(text[pos:end])
+		if end < len(text) {
+			b.WriteString(" …")
+		}
+		b.WriteString(" ")
 	}
-	result := make([]*Page, 0, len(pages))
-	for page := range pages {
-		result = append(result, page)
+	return strings.ReplaceAll(strings.TrimSpace(b.String()), "… …", "…")
+}
+
+// Returns the start and end offsets of the words (sequences of letters and
+// their combining marks) in the text
+func wordSpans(text string) [][2]int {
+	var result [][2]int
+	start := -1
+	for i, r := range text {
+		if unicode.IsLetter(r) || (start >= 0 && unicode.Is(unicode.Mn, r)) {
+			if start < 0 {
+				start = i
+			}
+		} else if start >= 0 {
+			result = append(result, [2]int{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		result = append(result, [2]int{start, len(text)})
 	}
-	sort.Slice(result, func(i, j int) bool {
-		return result[i].Title < result[j].Title
-	})
 	return result
 }
 
@@ -263,10 +1141,6 @@ func searchPages(query []string) []*Page {
 // Microblog
 ////////////////////////////////////////////////////////////////////////////////
 
-var mastodonID = "109530760716287685"
-var mastodonHost = "mas.to"
-var mastodonFetchInterval = 1 * time.Hour
-
 type Status struct {
 	ID        string
 	Content   string
@@ -280,24 +1154,36 @@ type Link struct {
 	Title string
 }
 
-var statuses []Status
-var lastStatusesFetch time.Time
-var statusesMu sync.Mutex
+func (c *capsule) serveMicroblog(w ResponseWriter, r *Request) {
+	if c.config.MastodonID == "" {
+		Error(w, StatusNotFound, "")
+		return
+	}
+	statuses, err := c.fetchStatuses()
+	if err != nil {
+		log.Printf("error fetching statuses: %v", err)
+		Error(w, StatusCGIError, "Unable to fetch statuses")
+		return
+	}
 
-func fetchStatuses() ([]Status, error) {
-	if time.Since(lastStatusesFetch) < mastodonFetchInterval {
-		return statuses, nil
+	w.WriteHeader(StatusSuccess, gemtextType(c.config.Lang))
+	if err := c.ublogTemplate.Execute(w, UBlogTemplateContext{Statuses: statuses}); err != nil {
+		log.Printf("error rendering: %v", err)
 	}
-	statusesMu.Lock()
-	defer statusesMu.Unlock()
-	if time.Since(lastStatusesFetch) < mastodonFetchInterval {
-		return statuses, nil
+}
+
+func (c *capsule) fetchStatuses() (_ []Status, err error) {
+	c.statusesMu.Lock()
+	defer c.statusesMu.Unlock()
+	if time.Since(c.lastStatusesFetch) < c.config.MastodonFetchInterval.Duration {
+		return c.statuses, nil
 	}
+	defer func() { c.metrics.fetch(err) }()
 
 	// https://docs.joinmastodon.org/methods/accounts/#statuses
-	url := fmt.Sprintf("https://%s/api/v1/accounts/%s/statuses?exclude_replies=1&exclude_reblogs=1&limit=50", mastodonHost, mastodonID)
-	if len(statuses) > 0 {
-		url = url + "&min_id=" + statuses[0].ID
+	url := fmt.Sprintf("https://%s/api/v1/accounts/%s/statuses?exclude_replies=1&exclude_reblogs=1&limit=50", c.config.MastodonHost, c.config.MastodonID)
+	if len(c.statuses) > 0 {
+		url = url + "&min_id=" + c.statuses[0].ID
 	}
 	log.Printf("fetching statuses: %s", url)
 	r, err := http.Get(url)
@@ -305,7 +1191,7 @@ func fetchStatuses() ([]Status, error) {
 		return nil, err
 	}
 	defer r.Body.Close()
-	lastStatusesFetch = time.Now()
+	c.lastStatusesFetch = time.Now()
 
 	var mstatuses []MStatus
 	if err := json.NewDecoder(r.Body).Decode(&mstatuses); err != nil {
@@ -313,8 +1199,8 @@ func fetchStatuses() ([]Status, error) {
 	}
 	log.Printf("fetched statuses: %d", len(mstatuses))
 	var nstatuses []Status
-	for _, s := range mstatuses {
-		tcontent := htmltagRE.ReplaceAllString(s.Content, "")
+	for _, ms := range mstatuses {
+		tcontent := htmltagRE.ReplaceAllString(ms.Content, "")
 		if len(tcontent) == 0 {
 			continue
 		}
@@ -330,22 +1216,22 @@ func fetchStatuses() ([]Status, error) {
 		} else {
 			pcontent = urlRE.ReplaceAllString(pcontent, "")
 		}
-		status := Status{ID: s.ID, Content: pcontent, CreatedAt: s.CreatedAt, URL: s.URL}
+		status := Status{ID: ms.ID, Content: pcontent, CreatedAt: ms.CreatedAt, URL: ms.URL}
 		for _, m := range lms {
-			if s.Card.URL == m[0] {
-				status.Links = append(status.Links, Link{URL: rewriteURL(s.Card.URL), Title: s.Card.Title})
+			if ms.Card.URL == m[0] {
+				status.Links = append(status.Links, Link{URL: c.rewriteURL(ms.Card.URL), Title: ms.Card.Title})
 			} else {
-				url := rewriteURL(m[0])
+				url := c.rewriteURL(m[0])
 				status.Links = append(status.Links, Link{URL: url, Title: stripURL(url)})
 			}
 		}
-		for _, ma := range s.MediaAttachments {
-			status.Links = append(status.Links, Link{URL: rewriteURL(ma.URL), Title: "🖼 " + ma.Description})
+		for _, ma := range ms.MediaAttachments {
+			status.Links = append(status.Links, Link{URL: c.rewriteURL(ma.URL), Title: "🖼 " + ma.Description})
 		}
 		nstatuses = append(nstatuses, status)
 	}
-	statuses = append(nstatuses, statuses...)
-	return statuses, nil
+	c.statuses = append(nstatuses, c.statuses...)
+	return c.statuses, nil
 }
 
 // https://docs.joinmastodon.org/entities/Status/
@@ -373,13 +1259,10 @@ var urlRE = regexp.MustCompile(`https?://[^ ]*`)
 // Common
 ////////////////////////////////////////////////////////////////////////////////
 
-var localRE = regexp.MustCompile(`^https?://mko.re`)
-
-func rewriteURL(url string) string {
-	if localRE.MatchString(url) {
-		path := strings.TrimRight(localRE.ReplaceAllString(url, ""), "/")
-		_, err := content.Open(pathToFile(path))
-		if err == nil {
+func (c *capsule) rewriteURL(url string) string {
+	if c.localRE != nil && c.localRE.MatchString(url) {
+		path := strings.TrimRight(c.localRE.ReplaceAllString(url, ""), "/")
+		if c.exists(path) {
 			return path
 		}
 	}
@@ -393,16 +1276,6 @@ func stripURL(fullurl string) string {
 	return u.String()
 }
 
-func pathToFile(path string) string {
-	if path == "/" || path == "" {
-		return "index.gmi"
-	} else if !strings.Contains(path, ".") {
-		return path[1:] + ".gmi"
-	} else {
-		return path[1:]
-	}
-}
-
 ////////////////////////////////////////////////////////////////////////////////
 // Resources
 ////////////////////////////////////////////////////////////////////////////////
@@ -413,25 +1286,32 @@ var serverkey []byte
 //go:embed server.crt
 var servercert []byte
 
-//go:embed gemsite all:gemsite/_admin.gmi
+//go:embed gemsite
 var assets embed.FS
-var content fs.FS
 
 //go:embed search.idx
-var searchidx string
+var searchidx []byte
+
+//go:embed redirects.idx
+var redirectsidx string
 
-//go:embed templates/search.gmi.tmpl
-var searchTmpl embed.FS
-var searchTemplate = template.Must(template.ParseFS(searchTmpl, "templates/search.gmi.tmpl"))
+//go:embed templates
+var templates embed.FS
 
 type SearchTemplateContext struct {
 	Query string
-	Pages []*Page
-}
 
-//go:embed templates/ublog.gmi.tmpl
-var ublogTmpl embed.FS
-var ublogTemplate = template.Must(template.ParseFS(ublogTmpl, "templates/ublog.gmi.tmpl"))
+	// Order of the results: SortRelevance or SortDate
+	Sort string
+
+	Pages []SearchResult
+
+	// Message explaining why the query could not be parsed
+	Error string
+
+	// Query words that were too short to search for
+	Ignored []string
+}
 
 type UBlogTemplateContext struct {
 	Statuses []Status
@@ -0,0 +1,205 @@
+package gemsite
+
+import (
+	"bufio"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Gemini status codes
+// See https://geminiprotocol.net/docs/protocol-specification.gmi#status-codes
+const (
+	StatusInput                     = 10
+	StatusSensitiveInput            = 11
+	StatusSuccess                   = 20
+	StatusRedirectTemporary         = 30
+	StatusRedirectPermanent         = 31
+	StatusTemporaryFailure          = 40
+	StatusServerUnavailable         = 41
+	StatusCGIError                  = 42
+	StatusProxyError                = 43
+	StatusSlowDown                  = 44
+	StatusPermanentFailure          = 50
+	StatusNotFound                  = 51
+	StatusGone                      = 52
+	StatusProxyRequestRefused       = 53
+	StatusBadRequest                = 59
+	StatusClientCertificateRequired = 60
+	StatusCertificateNotAuthorized  = 61
+	StatusCertificateNotValid       = 62
+)
+
+var statusText = map[int]string{
+	StatusInput:                     "Input",
+	StatusSensitiveInput:            "Sensitive input",
+	StatusSuccess:                   "Success",
+	StatusRedirectTemporary:         "Temporary redirect",
+	StatusRedirectPermanent:         "Permanent redirect",
+	StatusTemporaryFailure:          "Temporary failure",
+	StatusServerUnavailable:         "Server unavailable",
+	StatusCGIError:                  "CGI error",
+	StatusProxyError:                "Proxy error",
+	StatusSlowDown:                  "Slow down",
+	StatusPermanentFailure:          "Permanent failure",
+	StatusNotFound:                  "Not found",
+	StatusGone:                      "Gone",
+	StatusProxyRequestRefused:       "Proxy request refused",
+	StatusBadRequest:                "Bad request",
+	StatusClientCertificateRequired: "Client certificate required",
+	StatusCertificateNotAuthorized:  "Certificate not authorized",
+	StatusCertificateNotValid:       "Certificate not valid",
+}
+
+// Returns a human-readable description of a status code, or the empty string
+// if the code is unknown
+func StatusText(status int) string {
+	return statusText[status]
+}
+
+// Maximum length of the meta string of a response, in bytes
+const MaxMetaLength = 1024
+
+// Responds with an error status.
+// If meta is empty, the description of the status is used.
+func Error(w ResponseWriter, status int, meta string) {
+	w.WriteHeader(status, meta)
+}
+
+// Responds with a redirect to the given URL, which may be relative to the
+// request URL.
+// The status should be StatusRedirectTemporary or StatusRedirectPermanent.
+func Redirect(w ResponseWriter, url string, status int) {
+	w.WriteHeader(status, url)
+}
+
+// Responds to a Gemini request
+type Handler interface {
+	ServeGemini(w ResponseWriter, r *Request)
+}
+
+// Adapter to use an ordinary function as a Handler
+type HandlerFunc func(w ResponseWriter, r *Request)
+
+func (f HandlerFunc) ServeGemini(w ResponseWriter, r *Request) {
+	f(w, r)
+}
+
+// Used by a Handler to construct a response
+type ResponseWriter interface {
+	// Writes the response header.
+	// Only the first call has an effect.
+	// If meta is empty, the MIME type of a successful response is
+	// application/octet-stream, and the meta of other responses is the
+	// description of the status (see StatusText).
+	WriteHeader(status int, meta string)
+
+	// Writes the response body.
+	// If WriteHeader was not called yet, a "20 text/gemini" header is written
+	// first. Writing a body is only allowed for successful responses.
+	Write(b []byte) (int, error)
+}
+
+// A Gemini request
+type Request struct {
+	// The requested URL
+	URL *url.URL
+
+	// Address of the client
+	RemoteAddr net.Addr
+
+	// The client certificate, or nil if the client did not send one.
+	// The certificate is not verified; use VerifyCertificate.
+	Certificate *x509.Certificate
+
+	// The server name sent by the client using SNI, if any
+	ServerName string
+
+	// The uploaded content of Titan requests. Nil for Gemini requests.
+	Body io.Reader
+
+	// Certificates sent along with the client certificate
+	intermediates []*x509.Certificate
+
+	// CAs to verify client certificates against
+	clientCAs *x509.CertPool
+}
+
+// Returned by Request.VerifyCertificate
+var (
+	ErrNoCertificate      = errors.New("no client certificate")
+	ErrCertificateExpired = errors.New("client certificate expired or not yet valid")
+)
+
+// Verifies that the client certificate is currently valid, and is signed by
+// one of the capsule's client CAs.
+// Returns ErrNoCertificate if there is no client certificate, and
+// ErrCertificateExpired if the certificate is outside its validity period.
+func (r *Request) VerifyCertificate() error {
+	if r.Certificate == nil {
+		return ErrNoCertificate
+	}
+	now := time.Now()
+	if now.Before(r.Certificate.NotBefore) || now.After(r.Certificate.NotAfter) {
+		return ErrCertificateExpired
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range r.intermediates {
+		intermediates.AddCert(c)
+	}
+	_, err := r.Certificate.Verify(x509.VerifyOptions{
+		Roots:         r.clientCAs,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err
+}
+
+type response struct {
+	w           *bufio.Writer
+	wroteHeader bool
+	status      int
+}
+
+func newResponse(w io.Writer) *response {
+	return &response{w: bufio.NewWriter(w)}
+}
+
+func (r *response) WriteHeader(status int, meta string) {
+	if r.wroteHeader {
+		log.Printf("superfluous header: %d %s", status, meta)
+		return
+	}
+	r.wroteHeader = true
+	r.status = status
+	if meta == "" && status/10 == StatusSuccess/10 {
+		meta = "application/octet-stream"
+	} else if meta == "" {
+		meta = StatusText(status)
+	}
+	if len(meta) > MaxMetaLength {
+		meta = strings.ToValidUTF8(meta[:MaxMetaLength], "")
+	}
+	fmt.Fprintf(r.w, "%d %s\r\n", status, meta)
+}
+
+func (r *response) Write(b []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(StatusSuccess, "text/gemini")
+	}
+	if r.status != StatusSuccess {
+		return 0, fmt.Errorf("body not allowed for status %d", r.status)
+	}
+	return r.w.Write(b)
+}
+
+func (r *response) flush() error {
+	return r.w.Flush()
+}
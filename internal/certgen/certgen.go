@@ -0,0 +1,159 @@
+// Package certgen generates the server certificate (which also acts as the CA
+// for client certificates), and issues client certificates signed by it.
+package certgen
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+)
+
+// Key types
+const (
+	ECDSA   = "ecdsa"
+	Ed25519 = "ed25519"
+)
+
+// Generates a self-signed server certificate for the given host names and IP
+// addresses, valid for the given duration.
+// The first name is used as the common name.
+// Returns the certificate and the private key in PEM format.
+func Server(names []string, keyType string, validity time.Duration) ([]byte, []byte, error) {
+	if len(names) == 0 {
+		return nil, nil, errors.New("no host names")
+	}
+	key, err := generateKey(keyType)
+	if err != nil {
+		return nil, nil, err
+	}
+	template, err := newTemplate(names[0], validity)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+
+	// The server certificate is the CA of client certificates. As the extended
+	// key usage of a CA constrains the certificates it signs, it includes
+	// client authentication.
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+
+	return create(template, template, key, key)
+}
+
+// Issues a client certificate with the given common name, signed by the CA
+// certificate and key (in PEM format), and valid for the given duration.
+// Returns the certificate and the private key in PEM format.
+func Client(caCertPEM, caKeyPEM []byte, cn string, keyType string, validity time.Duration) ([]byte, []byte, error) {
+	ca, err := tls.X509KeyPair(caCertPEM, caKeyPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to load CA: %w", err)
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse CA certificate: %w", err)
+	}
+	caKey, ok := ca.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New("unsupported CA key")
+	}
+	key, err := generateKey(keyType)
+	if err != nil {
+		return nil, nil, err
+	}
+	template, err := newTemplate(cn, validity)
+	if err != nil {
+		return nil, nil, err
+	}
+	if template.NotAfter.After(caCert.NotAfter) {
+		template.NotAfter = caCert.NotAfter
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	return create(template, caCert, key, caKey)
+}
+
+// Parses all certificates in PEM data
+func Parse(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return certs, nil
+}
+
+func generateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case ECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case Ed25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", keyType)
+	}
+}
+
+func newTemplate(cn string, validity time.Duration) (*x509.Certificate, error) {
+	if validity <= 0 {
+		return nil, errors.New("validity must be positive")
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     now.Add(validity),
+	}, nil
+}
+
+func create(template, parent *x509.Certificate, key, parentKey crypto.Signer) ([]byte, []byte, error) {
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), nil
+}
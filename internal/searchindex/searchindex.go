@@ -0,0 +1,368 @@
+// Package searchindex reads and writes the binary search index generated by
+// buildgemsite.
+//
+// An index starts with a 16-byte header: the magic "GSIX", and the format
+// version, the CRC-32 (IEEE) checksum of the body, and the length of the body,
+// as little-endian 32-bit integers.
+// The body consists of the stop words, the documents, and a sorted term
+// dictionary with the postings of every term. Strings are prefixed with their
+// length, and numbers are unsigned varints, except for the term table, which
+// consists of fixed-size offsets so terms can be looked up in place using a
+// binary search.
+// Postings are lists of documents containing the term, with the positions of
+// the term in the document. Document numbers and positions are
+// delta-encoded.
+package searchindex
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strings"
+)
+
+const magic = "GSIX"
+
+// Version of the index format
+const Version = 1
+
+const headerSize = 16
+
+// Size of a term table entry: the offset of the term, and the offset of its
+// postings
+const termEntrySize = 8
+
+// An indexed page
+type Document struct {
+	URL      string
+	Title    string
+	Date     string
+	Featured bool
+	Tags     []string
+
+	// Number of indexed terms
+	Length int
+
+	// Text of the page, to show snippets from
+	Text string
+
+	// Terms of the page, with their positions.
+	// Only used when writing an index, and by Documents.
+	Terms map[string][]int
+}
+
+// A document containing a term, with the positions of the term
+type Posting struct {
+	Doc       int
+	Positions []int
+}
+
+// An index, read in place from its encoded data
+type Index struct {
+	StopWords []string
+	Docs      []Document
+
+	terms    []byte // Term table
+	termData []byte
+	postings []byte
+}
+
+// Writes an index of the documents, built with the given stop words
+func Write(w io.Writer, stopWords []string, docs []Document) error {
+	var body []byte
+	body = binary.AppendUvarint(body, uint64(len(stopWords)))
+	for _, word := range stopWords {
+		body = appendString(body, word)
+	}
+	body = binary.AppendUvarint(body, uint64(len(docs)))
+	for _, doc := range docs {
+		body = appendString(body, doc.URL)
+		body = appendString(body, doc.Title)
+		body = appendString(body, doc.Date)
+		if doc.Featured {
+			body = append(body, 1)
+		} else {
+			body = append(body, 0)
+		}
+		body = binary.AppendUvarint(body, uint64(len(doc.Tags)))
+		for _, tag := range doc.Tags {
+			body = appendString(body, tag)
+		}
+		body = binary.AppendUvarint(body, uint64(doc.Length))
+		body = appendString(body, doc.Text)
+	}
+
+	// Postings, by term
+	postings := map[string][]Posting{}
+	for i, doc := range docs {
+		for term, positions := range doc.Terms {
+			postings[term] = append(postings[term], Posting{Doc: i, Positions: positions})
+		}
+	}
+	terms := make([]string, 0, len(postings))
+	for term := range postings {
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+
+	var termTable, termData, postingsData []byte
+	for _, term := range terms {
+		termTable = binary.LittleEndian.AppendUint32(termTable, uint32(len(termData)))
+		termTable = binary.LittleEndian.AppendUint32(termTable, uint32(len(postingsData)))
+		termData = append(termData, term...)
+		ps := postings[term]
+		postingsData = binary.AppendUvarint(postingsData, uint64(len(ps)))
+		prevDoc := 0
+		for _, p := range ps {
+			postingsData = binary.AppendUvarint(postingsData, uint64(p.Doc-prevDoc))
+			prevDoc = p.Doc
+			positions := append([]int{}, p.Positions...)
+			sort.Ints(positions)
+			postingsData = binary.AppendUvarint(postingsData, uint64(len(positions)))
+			prevPos := 0
+			for _, pos := range positions {
+				postingsData = binary.AppendUvarint(postingsData, uint64(pos-prevPos))
+				prevPos = pos
+			}
+		}
+	}
+	if len(termData) > 1<<32-1 || len(postingsData) > 1<<32-1 {
+		return errors.New("search index too large")
+	}
+	body = binary.AppendUvarint(body, uint64(len(terms)))
+	body = append(body, termTable...)
+	body = binary.AppendUvarint(body, uint64(len(termData)))
+	body = append(body, termData...)
+	body = binary.AppendUvarint(body, uint64(len(postingsData)))
+	body = append(body, postingsData...)
+
+	header := []byte(magic)
+	header = binary.LittleEndian.AppendUint32(header, Version)
+	header = binary.LittleEndian.AppendUint32(header, crc32.ChecksumIEEE(body))
+	header = binary.LittleEndian.AppendUint32(header, uint32(len(body)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// Reads an index.
+// The postings are not decoded until they are looked up, and refer to the
+// given data, which must not be modified.
+func Read(data []byte) (*Index, error) {
+	if len(data) < headerSize || string(data[:len(magic)]) != magic {
+		return nil, errors.New("not a search index")
+	}
+	if v := binary.LittleEndian.Uint32(data[4:]); v != Version {
+		return nil, fmt.Errorf("unsupported search index version %d (expected %d); rebuild the index", v, Version)
+	}
+	checksum := binary.LittleEndian.Uint32(data[8:])
+	body := data[headerSize:]
+	if n := binary.LittleEndian.Uint32(data[12:]); uint64(n) != uint64(len(body)) {
+		return nil, fmt.Errorf("search index has %d bytes, expected %d (truncated?)", len(body), n)
+	}
+	if crc32.ChecksumIEEE(body) != checksum {
+		return nil, errors.New("search index checksum mismatch (corrupt index)")
+	}
+
+	d := decoder{b: body}
+	index := &Index{}
+	index.StopWords = make([]string, d.count())
+	for i := range index.StopWords {
+		index.StopWords[i] = d.string()
+	}
+	index.Docs = make([]Document, d.count())
+	for i := range index.Docs {
+		doc := &index.Docs[i]
+		doc.URL = d.string()
+		doc.Title = d.string()
+		doc.Date = d.string()
+		doc.Featured = d.bytes(1)[0] == 1
+		doc.Tags = make([]string, d.count())
+		for j := range doc.Tags {
+			doc.Tags[j] = d.string()
+		}
+		doc.Length = int(d.uvarint())
+		doc.Text = d.string()
+	}
+	numTerms := d.count()
+	index.terms = d.bytes(numTerms * termEntrySize)
+	index.termData = d.bytes(d.count())
+	index.postings = d.bytes(d.count())
+	if d.err != nil {
+		return nil, fmt.Errorf("invalid search index: %w", d.err)
+	}
+	if len(d.b) > 0 {
+		return nil, errors.New("invalid search index: trailing data")
+	}
+
+	// Validate the term table, so lookups can rely on it
+	var prev []byte
+	for i := 0; i < numTerms; i++ {
+		termOffset, postingsOffset := index.offsets(i)
+		nextTerm, nextPostings := len(index.termData), len(index.postings)
+		if i+1 < numTerms {
+			nextTerm, nextPostings = index.offsets(i + 1)
+		}
+		if termOffset < 0 || postingsOffset < 0 || termOffset > nextTerm || nextTerm > len(index.termData) || postingsOffset > nextPostings || nextPostings > len(index.postings) {
+			return nil, fmt.Errorf("invalid search index: invalid offsets of term %d", i)
+		}
+		term := index.termData[termOffset:nextTerm]
+		if i > 0 && bytes.Compare(prev, term) >= 0 {
+			return nil, errors.New("invalid search index: terms not sorted")
+		}
+		prev = term
+	}
+	return index, nil
+}
+
+// Returns the number of terms
+func (index *Index) NumTerms() int {
+	return len(index.terms) / termEntrySize
+}
+
+// Returns the offsets of the i'th term, and of its postings
+func (index *Index) offsets(i int) (int, int) {
+	entry := index.terms[i*termEntrySize:]
+	return int(binary.LittleEndian.Uint32(entry)), int(binary.LittleEndian.Uint32(entry[4:]))
+}
+
+// Returns the i'th term, and its encoded postings
+func (index *Index) term(i int) ([]byte, []byte) {
+	termOffset, postingsOffset := index.offsets(i)
+	nextTerm, nextPostings := len(index.termData), len(index.postings)
+	if i+1 < index.NumTerms() {
+		nextTerm, nextPostings = index.offsets(i + 1)
+	}
+	return index.termData[termOffset:nextTerm], index.postings[postingsOffset:nextPostings]
+}
+
+// Returns the number of the first term that is not smaller than s
+func (index *Index) search(s string) int {
+	return sort.Search(index.NumTerms(), func(i int) bool {
+		term, _ := index.term(i)
+		return string(term) >= s
+	})
+}
+
+// Returns the documents containing a term, ordered by document number
+func (index *Index) Postings(term string) []Posting {
+	i := index.search(term)
+	if i == index.NumTerms() {
+		return nil
+	}
+	t, postings := index.term(i)
+	if string(t) != term {
+		return nil
+	}
+	return index.decodePostings(postings)
+}
+
+// Decodes postings. Postings of a valid index (see Read) always decode, so
+// invalid postings are dropped.
+func (index *Index) decodePostings(b []byte) []Posting {
+	d := decoder{b: b}
+	result := make([]Posting, d.count())
+	doc := 0
+	for i := range result {
+		doc += int(d.uvarint())
+		positions := make([]int, d.count())
+		pos := 0
+		for j := range positions {
+			pos += int(d.uvarint())
+			positions[j] = pos
+		}
+		result[i] = Posting{Doc: doc, Positions: positions}
+	}
+	if d.err != nil || (len(result) > 0 && result[len(result)-1].Doc >= len(index.Docs)) {
+		return nil
+	}
+	return result
+}
+
+// Returns the terms starting with a prefix, sorted
+func (index *Index) Terms(prefix string) []string {
+	var result []string
+	for i := index.search(prefix); i < index.NumTerms(); i++ {
+		term, _ := index.term(i)
+		if !strings.HasPrefix(string(term), prefix) {
+			break
+		}
+		result = append(result, string(term))
+	}
+	return result
+}
+
+// Returns the documents, with their terms.
+// All postings are decoded, so this is only meant for small indexes.
+func (index *Index) Documents() []Document {
+	docs := make([]Document, len(index.Docs))
+	copy(docs, index.Docs)
+	for i := range docs {
+		docs[i].Terms = map[string][]int{}
+	}
+	for i := 0; i < index.NumTerms(); i++ {
+		term, postings := index.term(i)
+		for _, p := range index.decodePostings(postings) {
+			docs[p.Doc].Terms[string(term)] = p.Positions
+		}
+	}
+	return docs
+}
+
+// Decodes the parts of an index.
+// The first error is kept, after which all reads return zero values.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = errors.New("invalid number")
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+// Reads a number of items or bytes that follow.
+// As every item takes at least one byte, larger numbers are invalid.
+func (d *decoder) count() int {
+	n := d.uvarint()
+	if n > uint64(len(d.b)) {
+		d.err = errors.New("invalid length")
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if d.err == nil && n > len(d.b) {
+		d.err = errors.New("unexpected end of data")
+	}
+	if d.err != nil {
+		return make([]byte, n)
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes(d.count()))
+}
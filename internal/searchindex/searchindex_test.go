@@ -0,0 +1,270 @@
+package searchindex
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var testDocs = []Document{
+	{
+		URL:      "/blog/monads",
+		Title:    "Monads in Haskell",
+		Date:     "2023-01-02",
+		Featured: true,
+		Tags:     []string{"haskell", "fp"},
+		Length:   4,
+		Text:     "Monads in Haskell. A monad is a monoid.",
+		Terms: map[string][]int{
+			"monad":  {0, 4},
+			"haskel": {2},
+			"monoid": {7},
+		},
+	},
+	{
+		URL:    "/blog/cafe",
+		Title:  "Café",
+		Date:   "2024-05-06",
+		Length: 2,
+		Text:   "Café monads",
+		Terms: map[string][]int{
+			"cafe":  {0},
+			"monad": {1},
+		},
+	},
+	{
+		URL:   "/empty",
+		Title: "Empty",
+		Terms: map[string][]int{},
+	},
+}
+
+var testStopWords = []string{"the", "and"}
+
+func write(t *testing.T, stopWords []string, docs []Document) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := Write(&b, stopWords, docs); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// Updates the checksum and length in the header of a modified index
+func reseal(data []byte) []byte {
+	body := data[headerSize:]
+	binary.LittleEndian.PutUint32(data[8:], crc32.ChecksumIEEE(body))
+	binary.LittleEndian.PutUint32(data[12:], uint32(len(body)))
+	return data
+}
+
+func TestRoundTrip(t *testing.T) {
+	index, err := Read(write(t, testStopWords, testDocs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(index.StopWords, testStopWords) {
+		t.Errorf("StopWords = %q, want %q", index.StopWords, testStopWords)
+	}
+	if n := index.NumTerms(); n != 4 {
+		t.Errorf("NumTerms = %d, want 4", n)
+	}
+	for i, doc := range index.Docs {
+		want := testDocs[i]
+		want.Terms = nil
+		if len(want.Tags) == 0 {
+			want.Tags = []string{}
+		}
+		if !reflect.DeepEqual(doc, want) {
+			t.Errorf("Docs[%d] = %+v, want %+v", i, doc, want)
+		}
+	}
+
+	for _, test := range []struct {
+		term     string
+		postings []Posting
+	}{
+		{"monad", []Posting{{Doc: 0, Positions: []int{0, 4}}, {Doc: 1, Positions: []int{1}}}},
+		{"cafe", []Posting{{Doc: 1, Positions: []int{0}}}},
+		{"mon", nil},
+		{"zzz", nil},
+		{"", nil},
+	} {
+		if postings := index.Postings(test.term); !reflect.DeepEqual(postings, test.postings) {
+			t.Errorf("Postings(%q) = %v, want %v", test.term, postings, test.postings)
+		}
+	}
+
+	for _, test := range []struct {
+		prefix string
+		terms  []string
+	}{
+		{"mon", []string{"monad", "monoid"}},
+		{"monad", []string{"monad"}},
+		{"c", []string{"cafe"}},
+		{"", []string{"cafe", "haskel", "monad", "monoid"}},
+		{"x", nil},
+	} {
+		if terms := index.Terms(test.prefix); !slices.Equal(terms, test.terms) {
+			t.Errorf("Terms(%q) = %q, want %q", test.prefix, terms, test.terms)
+		}
+	}
+
+	docs := index.Documents()
+	for i, doc := range docs {
+		if !reflect.DeepEqual(doc.Terms, testDocs[i].Terms) {
+			t.Errorf("Documents()[%d].Terms = %v, want %v", i, doc.Terms, testDocs[i].Terms)
+		}
+	}
+}
+
+func TestRoundTripEmpty(t *testing.T) {
+	index, err := Read(write(t, nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.StopWords) != 0 || len(index.Docs) != 0 || index.NumTerms() != 0 {
+		t.Errorf("unexpected contents: %+v", index)
+	}
+	if postings := index.Postings("monad"); postings != nil {
+		t.Errorf("Postings = %v, want none", postings)
+	}
+	if terms := index.Terms(""); terms != nil {
+		t.Errorf("Terms = %q, want none", terms)
+	}
+}
+
+func TestWriteSortsPositions(t *testing.T) {
+	index, err := Read(write(t, nil, []Document{{URL: "/", Terms: map[string][]int{"monad": {5, 1, 3}}}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Posting{{Doc: 0, Positions: []int{1, 3, 5}}}
+	if postings := index.Postings("monad"); !reflect.DeepEqual(postings, want) {
+		t.Errorf("Postings = %v, want %v", postings, want)
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	valid := write(t, testStopWords, testDocs)
+
+	// Term table, followed by the length of the term data, and the term data
+	termData := bytes.Index(valid, []byte("cafehaskelmonadmonoid"))
+	termTable := termData - 1 - 4*termEntrySize
+
+	for _, test := range []struct {
+		name   string
+		modify func([]byte) []byte
+		err    string
+	}{
+		{
+			"empty",
+			func(b []byte) []byte { return nil },
+			"not a search index",
+		},
+		{
+			"text",
+			func(b []byte) []byte { return []byte("monad /blog/monads 0 4\n") },
+			"not a search index",
+		},
+		{
+			"bad magic",
+			func(b []byte) []byte { b[0] = 'X'; return b },
+			"not a search index",
+		},
+		{
+			"wrong version",
+			func(b []byte) []byte { binary.LittleEndian.PutUint32(b[4:], Version+1); return b },
+			"unsupported search index version 2 (expected 1)",
+		},
+		{
+			"truncated",
+			func(b []byte) []byte { return b[:len(b)-10] },
+			"truncated?",
+		},
+		{
+			"trailing data",
+			func(b []byte) []byte { return append(b, 0) },
+			"truncated?",
+		},
+		{
+			"flipped checksum",
+			func(b []byte) []byte { b[8] ^= 1; return b },
+			"checksum mismatch",
+		},
+		{
+			"flipped body",
+			func(b []byte) []byte { b[len(b)-1] ^= 1; return b },
+			"checksum mismatch",
+		},
+		{
+			"unsorted terms",
+			func(b []byte) []byte {
+				copy(b[termData:], "cafehaskelmonoidmonad")
+				binary.LittleEndian.PutUint32(b[termTable+3*termEntrySize:], uint32(len("cafehaskelmonoid")))
+				return reseal(b)
+			},
+			"terms not sorted",
+		},
+		{
+			"duplicate terms",
+			func(b []byte) []byte {
+				copy(b[termData:], "cafecafe")
+				binary.LittleEndian.PutUint32(b[termTable+termEntrySize:], 4)
+				binary.LittleEndian.PutUint32(b[termTable+2*termEntrySize:], 8)
+				binary.LittleEndian.PutUint32(b[termTable+3*termEntrySize:], 8)
+				return reseal(b)
+			},
+			"terms not sorted",
+		},
+		{
+			"term offset out of range",
+			func(b []byte) []byte {
+				binary.LittleEndian.PutUint32(b[termTable+3*termEntrySize:], 1000)
+				return reseal(b)
+			},
+			"invalid offsets of term 2",
+		},
+		{
+			"decreasing term offsets",
+			func(b []byte) []byte {
+				binary.LittleEndian.PutUint32(b[termTable+2*termEntrySize:], 2)
+				return reseal(b)
+			},
+			"invalid offsets of term 1",
+		},
+		{
+			"postings offset out of range",
+			func(b []byte) []byte {
+				binary.LittleEndian.PutUint32(b[termTable+3*termEntrySize+4:], 1000)
+				return reseal(b)
+			},
+			"invalid offsets of term 2",
+		},
+		{
+			"body truncated with valid checksum",
+			func(b []byte) []byte { return reseal(b[:len(b)-10]) },
+			"invalid search index",
+		},
+		{
+			"trailing data with valid checksum",
+			func(b []byte) []byte { return reseal(append(b, 0)) },
+			"trailing data",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			data := test.modify(bytes.Clone(valid))
+			index, err := Read(data)
+			if err == nil {
+				t.Fatalf("Read succeeded: %+v", index)
+			}
+			if !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Read error = %q, want %q", err, test.err)
+			}
+		})
+	}
+}
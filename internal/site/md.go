@@ -1,4 +1,4 @@
-package main
+package site
 
 import (
 	"bufio"
@@ -92,6 +92,8 @@ func ConvertMarkdownToGemtext(in io.Reader, outw io.Writer) (Page, error) {
 	scn.Split(bufio.ScanLines)
 	page := Page{}
 	var commentURL string
+	// List front matter field being parsed, for lists of `- item` lines
+	var inList *[]string
 	for scn.Scan() {
 		line := scn.Text()
 
@@ -102,15 +104,31 @@ func ConvertMarkdownToGemtext(in io.Reader, outw io.Writer) (Page, error) {
 				return page, fmt.Errorf("missing front matter")
 			}
 		} else if state == InFrontMatter {
+			if inList != nil {
+				if item, ok := strings.CutPrefix(strings.TrimSpace(line), "- "); ok {
+					*inList = append(*inList, unquote(strings.TrimSpace(item)))
+					continue
+				}
+				inList = nil
+			}
 			if strings.HasPrefix(line, "---") {
 				state = InBody
 			} else if strings.HasPrefix(line, "title: ") {
-				title := strings.TrimSpace(line[7:])
-				title = title[1 : len(title)-1]
+				value := strings.TrimSpace(line[7:])
+				title := unquote(value)
+				if title == "" {
+					return page, fmt.Errorf("empty title")
+				} else if title == value && strings.ContainsAny(value[:1], `"'`) {
+					return page, fmt.Errorf("unterminated quote in title: %s", value)
+				}
 				page.Title = title
 				out.WriteString(fmt.Sprintf("# %s\n\n", title))
 			} else if strings.HasPrefix(line, "commentURL: ") {
 				commentURL = strings.TrimSpace(line[11:])
+			} else if strings.HasPrefix(line, "aliases:") {
+				inList = parseList(line[8:], &page.Aliases)
+			} else if strings.HasPrefix(line, "tags:") {
+				inList = parseList(line[5:], &page.Tags)
 			} else if strings.HasPrefix(line, "featured: ") {
 				page.Featured = true
 			} else if strings.HasPrefix(line, "date: ") {
@@ -119,7 +137,7 @@ func ConvertMarkdownToGemtext(in io.Reader, outw io.Writer) (Page, error) {
 					return page, err
 				}
 				page.Time = t
-				out.WriteString(fmt.Sprintf("%s · %s\n\n", author, t.Format("January 2, 2006")))
+				out.WriteString(fmt.Sprintf("%s · %s\n\n", Author, t.Format("January 2, 2006")))
 			}
 		} else {
 			if state == InTable && !strings.HasPrefix(line, `|`) {
@@ -211,3 +229,25 @@ func ConvertMarkdownToGemtext(in io.Reader, outw io.Writer) (Page, error) {
 
 	return page, nil
 }
+
+// Parses a front matter list into items: either an inline list
+// (`["/a", "/b"]`), or a list of `- /a` items on the following lines.
+// Returns the list if its items are on the following lines.
+func parseList(value string, items *[]string) *[]string {
+	for _, item := range strings.Split(strings.Trim(strings.TrimSpace(value), "[]"), ",") {
+		if item = unquote(strings.TrimSpace(item)); item != "" {
+			*items = append(*items, item)
+		}
+	}
+	if len(*items) == 0 {
+		return items
+	}
+	return nil
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
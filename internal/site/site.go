@@ -0,0 +1,185 @@
+// Package site contains the parts of building a capsule that are shared
+// between the builder and the server: converting Markdown, parsing pages,
+// collecting posts, and extracting words to index.
+package site
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/remko/gemsite/internal/searchindex"
+	"github.com/remko/gemsite/internal/tokenizer"
+)
+
+// Author of the capsule, shown on converted Markdown pages
+var Author = "Remko Tronçon"
+
+// Pages generated from the templates in the template directory
+var Generated = []string{"blog.gmi", "index.gmi"}
+
+type Site struct {
+	Posts []Page
+}
+
+// Collects the posts from the given pages, most recent first
+func NewSite(pages []Page) Site {
+	site := Site{Posts: []Page{}}
+	for _, page := range pages {
+		if strings.HasPrefix(page.Path, "blog/") && !page.Time.IsZero() && page.Title != "" {
+			site.Posts = append(site.Posts, page)
+		}
+	}
+	sort.Slice(site.Posts, func(i, j int) bool {
+		return site.Posts[i].Time.After(site.Posts[j].Time)
+	})
+	return site
+}
+
+// Renders a generated page, using its template from the given file system
+func (s Site) Render(templates fs.FS, name string, w io.Writer) error {
+	tmpl, err := template.ParseFS(templates, name+".tmpl")
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(w, s)
+}
+
+type Page struct {
+	URL      string
+	Path     string
+	Time     time.Time
+	Title    string
+	Featured bool
+	Aliases  []string
+	Tags     []string
+}
+
+func (p Page) Date() string {
+	return p.Time.Format(time.DateOnly)
+}
+
+// Parses the title and date of a gemtext page
+func ParsePage(content fs.FS, path string) (Page, error) {
+	f, err := content.Open(path)
+	if err != nil {
+		return Page{}, err
+	}
+	defer f.Close()
+	return ParseGemtext(f)
+}
+
+// Parses the title and date of gemtext
+func ParseGemtext(r io.Reader) (Page, error) {
+	page := Page{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" {
+			continue
+		}
+		if page.Title == "" {
+			if !strings.HasPrefix(line, "# ") {
+				return page, fmt.Errorf("missing title")
+			}
+			page.Title = strings.Trim(line[1:], " ")
+		} else {
+			if t, ok := parseByline(line); ok {
+				page.Time = t
+			}
+			break
+		}
+	}
+	return page, s.Err()
+}
+
+// Parses the date of a byline (`Author · January 2, 2006`), which follows the
+// title
+func parseByline(line string) (time.Time, bool) {
+	_, rawdate, found := strings.Cut(line, "·")
+	if !found {
+		return time.Time{}, false
+	}
+	t, err := time.Parse("January _2, 2006", strings.Trim(rawdate, " "))
+	return t, err == nil
+}
+
+// Returns the terms of a gemtext page to index (see tokenizer.Terms), with
+// their positions, and the text of the page (without title, byline, links and
+// markup, on a single line) to show search result snippets from.
+// Positions count all words, including the ones that are not indexed, so
+// phrases with short words can be matched.
+// Links and the author's name are not indexed.
+func IndexContent(r io.Reader, tok *tokenizer.Tokenizer) (map[string][]int, string, error) {
+	skip := tok.Terms(Author)
+	terms := map[string][]int{}
+	var text []string
+	pos := 0
+	afterTitle := false
+	ls := bufio.NewScanner(r)
+	for ls.Scan() {
+		line := ls.Text()
+		if strings.HasPrefix(line, "=>") {
+			continue
+		}
+		for _, term := range tok.Terms(line) {
+			if term != "" && !contains(skip, term) {
+				terms[term] = append(terms[term], pos)
+			}
+			pos++
+		}
+		// The title (the level 1 heading) and the byline are shown with
+		// snippets already
+		if strings.HasPrefix(line, "# ") {
+			afterTitle = len(text) == 0
+			continue
+		}
+		if afterTitle && line != "" {
+			afterTitle = false
+			if _, ok := parseByline(line); ok {
+				continue
+			}
+		}
+		if line = strings.TrimSpace(strings.TrimLeft(line, "#>*`")); line != "" {
+			text = append(text, line)
+		}
+	}
+	return terms, strings.Join(text, " "), ls.Err()
+}
+
+// Returns the search index document of a page, with its terms and text (see
+// IndexContent)
+func IndexDocument(page Page, terms map[string][]int, text string) searchindex.Document {
+	length := 0
+	for _, positions := range terms {
+		length += len(positions)
+	}
+	tags := make([]string, len(page.Tags))
+	for i, tag := range page.Tags {
+		tags[i] = tokenizer.Fold(tag)
+	}
+	return searchindex.Document{
+		URL:      page.URL,
+		Title:    page.Title,
+		Date:     page.Date(),
+		Featured: page.Featured,
+		Tags:     tags,
+		Length:   length,
+		Text:     text,
+		Terms:    terms,
+	}
+}
+
+func contains(s []string, str string) bool {
+	for _, v := range s {
+		if v == str {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,202 @@
+package tokenizer
+
+// Returns the stem of a lowercase English word, using the Porter stemming
+// algorithm.
+// See https://tartarus.org/martin/PorterStemmer/def.txt
+// Words with other letters than a-z are returned unchanged.
+func Stem(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	for i := 0; i < len(word); i++ {
+		if word[i] < 'a' || word[i] > 'z' {
+			return word
+		}
+	}
+	s := stemmer{[]byte(word)}
+	s.step1a()
+	s.step1b()
+	s.step1c()
+	s.step2()
+	s.step3()
+	s.step4()
+	s.step5()
+	return string(s.b)
+}
+
+type stemmer struct {
+	b []byte
+}
+
+// A suffix replacement
+type rule struct {
+	suffix      string
+	replacement string
+}
+
+// Whether the letter at position i of b is a consonant
+func isConsonant(b []byte, i int) bool {
+	switch b[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !isConsonant(b, i-1)
+	}
+	return true
+}
+
+// Returns the number of vowel-consonant sequences in b
+func measure(b []byte) int {
+	m := 0
+	vowel := false
+	for i := range b {
+		if isConsonant(b, i) {
+			if vowel {
+				m++
+			}
+			vowel = false
+		} else {
+			vowel = true
+		}
+	}
+	return m
+}
+
+func hasVowel(b []byte) bool {
+	for i := range b {
+		if !isConsonant(b, i) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether b ends with a double consonant
+func endsDoubleConsonant(b []byte) bool {
+	n := len(b)
+	return n >= 2 && b[n-1] == b[n-2] && isConsonant(b, n-1)
+}
+
+// Whether b ends with consonant-vowel-consonant, where the last consonant is
+// not w, x or y
+func endsCVC(b []byte) bool {
+	n := len(b)
+	if n < 3 || !isConsonant(b, n-3) || isConsonant(b, n-2) || !isConsonant(b, n-1) {
+		return false
+	}
+	return b[n-1] != 'w' && b[n-1] != 'x' && b[n-1] != 'y'
+}
+
+// Returns the part of the word before the suffix, if it ends with it
+func (s *stemmer) stem(suffix string) ([]byte, bool) {
+	if len(s.b) < len(suffix) || string(s.b[len(s.b)-len(suffix):]) != suffix {
+		return nil, false
+	}
+	return s.b[:len(s.b)-len(suffix)], true
+}
+
+// Replaces the first suffix of the rules that the word ends with, if the
+// rest of the word has a measure larger than min
+func (s *stemmer) replace(rules []rule, min int) {
+	for _, r := range rules {
+		if stem, ok := s.stem(r.suffix); ok {
+			if measure(stem) > min {
+				s.b = append(stem, r.replacement...)
+			}
+			return
+		}
+	}
+}
+
+// Plurals
+func (s *stemmer) step1a() {
+	for _, r := range []rule{{"sses", "ss"}, {"ies", "i"}, {"ss", "ss"}, {"s", ""}} {
+		if stem, ok := s.stem(r.suffix); ok {
+			s.b = append(stem, r.replacement...)
+			return
+		}
+	}
+}
+
+// Past participles and gerunds
+func (s *stemmer) step1b() {
+	if stem, ok := s.stem("eed"); ok {
+		if measure(stem) > 0 {
+			s.b = append(stem, "ee"...)
+		}
+		return
+	}
+	stem, ok := s.stem("ed")
+	if !ok {
+		stem, ok = s.stem("ing")
+	}
+	if !ok || !hasVowel(stem) {
+		return
+	}
+	s.b = stem
+	for _, r := range []rule{{"at", "ate"}, {"bl", "ble"}, {"iz", "ize"}} {
+		if stem, ok := s.stem(r.suffix); ok {
+			s.b = append(stem, r.replacement...)
+			return
+		}
+	}
+	if endsDoubleConsonant(s.b) {
+		if last := s.b[len(s.b)-1]; last != 'l' && last != 's' && last != 'z' {
+			s.b = s.b[:len(s.b)-1]
+		}
+	} else if measure(s.b) == 1 && endsCVC(s.b) {
+		s.b = append(s.b, 'e')
+	}
+}
+
+func (s *stemmer) step1c() {
+	if stem, ok := s.stem("y"); ok && hasVowel(stem) {
+		s.b = append(stem, 'i')
+	}
+}
+
+// Double suffixes
+func (s *stemmer) step2() {
+	s.replace([]rule{
+		{"ational", "ate"}, {"tional", "tion"}, {"enci", "ence"}, {"anci", "ance"},
+		{"izer", "ize"}, {"abli", "able"}, {"alli", "al"}, {"entli", "ent"},
+		{"eli", "e"}, {"ousli", "ous"}, {"ization", "ize"}, {"ation", "ate"},
+		{"ator", "ate"}, {"alism", "al"}, {"iveness", "ive"}, {"fulness", "ful"},
+		{"ousness", "ous"}, {"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"},
+	}, 0)
+}
+
+func (s *stemmer) step3() {
+	s.replace([]rule{
+		{"icate", "ic"}, {"ative", ""}, {"alize", "al"}, {"iciti", "ic"},
+		{"ical", "ic"}, {"ful", ""}, {"ness", ""},
+	}, 0)
+}
+
+func (s *stemmer) step4() {
+	// -ion is only removed after s or t
+	if stem, ok := s.stem("ion"); ok {
+		if n := len(stem); n > 0 && (stem[n-1] == 's' || stem[n-1] == 't') && measure(stem) > 1 {
+			s.b = stem
+		}
+		return
+	}
+	s.replace([]rule{
+		{"al", ""}, {"ance", ""}, {"ence", ""}, {"er", ""}, {"ic", ""},
+		{"able", ""}, {"ible", ""}, {"ant", ""}, {"ement", ""}, {"ment", ""},
+		{"ent", ""}, {"ou", ""}, {"ism", ""}, {"ate", ""}, {"iti", ""},
+		{"ous", ""}, {"ive", ""}, {"ize", ""},
+	}, 1)
+}
+
+// Final -e and -ll
+func (s *stemmer) step5() {
+	if stem, ok := s.stem("e"); ok {
+		if m := measure(stem); m > 1 || (m == 1 && !endsCVC(stem)) {
+			s.b = stem
+		}
+	}
+	if measure(s.b) > 1 && endsDoubleConsonant(s.b) && s.b[len(s.b)-1] == 'l' {
+		s.b = s.b[:len(s.b)-1]
+	}
+}
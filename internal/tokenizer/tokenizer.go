@@ -0,0 +1,151 @@
+// Package tokenizer splits text into the terms that are indexed and searched
+// for, so that the index builder and the server treat words the same way.
+// Words are normalized to lowercase without accents, and reduced to their
+// (English) stem. Short words and stop words are not indexed. Digits are not
+// part of words, so numbers (e.g. years) are not indexed, and `x509` is the
+// word `x`.
+package tokenizer
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Minimum number of letters of an indexed word
+const MinWordLength = 3
+
+// Common English words that are not indexed
+var DefaultStopWords = []string{
+	"about", "after", "all", "also", "and", "any", "are", "because", "been",
+	"before", "being", "but", "can", "could", "did", "does", "doing", "for",
+	"from", "had", "has", "have", "her", "here", "hers", "him", "his", "how",
+	"into", "its", "just", "more", "most", "not", "now", "off", "once", "only",
+	"other", "our", "ours", "out", "over", "own", "same", "she", "should",
+	"some", "such", "than", "that", "the", "their", "theirs", "them", "then",
+	"there", "these", "they", "this", "those", "through", "too", "under",
+	"until", "very", "was", "were", "what", "when", "where", "which", "while",
+	"who", "whom", "why", "will", "with", "would", "you", "your", "yours",
+}
+
+type Tokenizer struct {
+	stopWords map[string]bool
+}
+
+// Creates a tokenizer that doesn't index the given stop words
+func New(stopWords []string) *Tokenizer {
+	t := &Tokenizer{stopWords: map[string]bool{}}
+	for _, w := range stopWords {
+		t.stopWords[Fold(w)] = true
+	}
+	return t
+}
+
+// Returns the term to index or search for of a word (as returned by Words):
+// its stem, or "" if it is too short or a stop word
+func (t *Tokenizer) Term(word string) string {
+	if utf8.RuneCountInString(word) < MinWordLength || t.stopWords[word] {
+		return ""
+	}
+	return Stem(word)
+}
+
+// Splits text into the terms of its words (see Term).
+// Words that are not indexed have an empty term, so the positions of the terms
+// are the positions of the words.
+func (t *Tokenizer) Terms(s string) []string {
+	words := Words(s)
+	for i, word := range words {
+		words[i] = t.Term(word)
+	}
+	return words
+}
+
+// Splits normalized text (see Fold) into words (sequences of letters).
+// Digits and other non-letters separate words.
+func Words(s string) []string {
+	return strings.FieldsFunc(Fold(s), func(r rune) bool { return !unicode.IsLetter(r) })
+}
+
+// Normalizes text to lowercase, and removes accents and ligatures (e.g.
+// "Ærøskøbing" becomes "aeroskobing").
+// Combining marks are dropped, so composed and decomposed letters are
+// normalized the same way.
+func Fold(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		r = unicode.ToLower(r)
+		if f, ok := foldings[r]; ok {
+			b.WriteString(f)
+		} else if r >= 'ａ' && r <= 'ｚ' {
+			b.WriteByte(byte('a' + r - 'ａ'))
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// Replacements of lowercase letters with accents and ligatures
+var foldings = map[rune]string{}
+
+func init() {
+	for _, f := range []struct{ to, from string }{
+		{"a", "àáâãäåāăąǎǟǡǻȁȃȧạảấầẩẫậắằẳẵặ"},
+		{"ae", "æǣǽ"},
+		{"b", "ḃ"},
+		{"c", "çćĉċč"},
+		{"d", "ďđðḋ"},
+		{"e", "èéêëēĕėęěȅȇȩẹẻẽếềểễệ"},
+		{"f", "ḟ"},
+		{"g", "ĝğġģǧǵ"},
+		{"h", "ĥħ"},
+		{"i", "ìíîïĩīĭįıǐȉȋỉị"},
+		{"ij", "ĳ"},
+		{"j", "ĵǰ"},
+		{"k", "ķǩ"},
+		{"l", "ĺļľŀł"},
+		{"n", "ñńņňŉǹ"},
+		{"o", "òóôõöøōŏőǒǫǭǿȍȏȫȭȯȱọỏốồổỗộớờởỡợơ"},
+		{"oe", "œ"},
+		{"r", "ŕŗřȑȓ"},
+		{"s", "śŝşšșṡ"},
+		{"ss", "ß"},
+		{"t", "ţťŧțṫ"},
+		{"th", "þ"},
+		{"u", "ùúûüũūŭůűųǔǖǘǚǜȕȗụủứừửữựư"},
+		{"w", "ŵẁẃẅ"},
+		{"y", "ýÿŷỳỵỷỹ"},
+		{"z", "źżžƶ"},
+		{"ff", "ﬀ"},
+		{"fi", "ﬁ"},
+		{"fl", "ﬂ"},
+		{"ffi", "ﬃ"},
+		{"ffl", "ﬄ"},
+		{"st", "ﬅﬆ"},
+	} {
+		for _, r := range f.from {
+			foldings[r] = f.to
+		}
+	}
+}
+
+// Reads a stop word list, consisting of whitespace-separated words.
+// Lines starting with # are comments.
+func ReadStopWords(r io.Reader) ([]string, error) {
+	var result []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		result = append(result, strings.Fields(line)...)
+	}
+	return result, s.Err()
+}
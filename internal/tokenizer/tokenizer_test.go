@@ -0,0 +1,172 @@
+package tokenizer
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Examples from the definition of the Porter stemming algorithm
+// (https://tartarus.org/martin/PorterStemmer/def.txt)
+var porterTests = []struct{ word, stem string }{
+	// Step 1a
+	{"caresses", "caress"},
+	{"ponies", "poni"},
+	{"ties", "ti"},
+	{"caress", "caress"},
+	{"cats", "cat"},
+
+	// Step 1b
+	{"feed", "feed"},
+	{"agreed", "agre"},
+	{"plastered", "plaster"},
+	{"bled", "bled"},
+	{"motoring", "motor"},
+	{"sing", "sing"},
+	{"conflated", "conflat"},
+	{"troubled", "troubl"},
+	{"sized", "size"},
+	{"hopping", "hop"},
+	{"tanned", "tan"},
+	{"falling", "fall"},
+	{"hissing", "hiss"},
+	{"fizzed", "fizz"},
+	{"failing", "fail"},
+	{"filing", "file"},
+
+	// Step 1c
+	{"happy", "happi"},
+	{"sky", "sky"},
+
+	// Step 2
+	{"relational", "relat"},
+	{"conditional", "condit"},
+	{"rational", "ration"},
+	{"valenci", "valenc"},
+	{"hesitanci", "hesit"},
+	{"digitizer", "digit"},
+	{"conformabli", "conform"},
+	{"radicalli", "radic"},
+	{"differentli", "differ"},
+	{"vileli", "vile"},
+	{"analogousli", "analog"},
+	{"vietnamization", "vietnam"},
+	{"predication", "predic"},
+	{"operator", "oper"},
+	{"feudalism", "feudal"},
+	{"decisiveness", "decis"},
+	{"hopefulness", "hope"},
+	{"callousness", "callous"},
+	{"formaliti", "formal"},
+	{"sensitiviti", "sensit"},
+	{"sensibiliti", "sensibl"},
+
+	// Step 3
+	{"triplicate", "triplic"},
+	{"formative", "form"},
+	{"formalize", "formal"},
+	{"electriciti", "electr"},
+	{"electrical", "electr"},
+	{"hopeful", "hope"},
+	{"goodness", "good"},
+
+	// Step 4
+	{"revival", "reviv"},
+	{"allowance", "allow"},
+	{"inference", "infer"},
+	{"airliner", "airlin"},
+	{"gyroscopic", "gyroscop"},
+	{"adjustable", "adjust"},
+	{"defensible", "defens"},
+	{"irritant", "irrit"},
+	{"replacement", "replac"},
+	{"adjustment", "adjust"},
+	{"dependent", "depend"},
+	{"adoption", "adopt"},
+	{"homologou", "homolog"},
+	{"communism", "commun"},
+	{"activate", "activ"},
+	{"angulariti", "angular"},
+	{"homologous", "homolog"},
+	{"effective", "effect"},
+	{"bowdlerize", "bowdler"},
+
+	// Step 5
+	{"probate", "probat"},
+	{"rate", "rate"},
+	{"cease", "ceas"},
+	{"controll", "control"},
+	{"roll", "roll"},
+
+	// Generalizations are stemmed in multiple steps
+	{"generalizations", "gener"},
+	{"oscillators", "oscil"},
+
+	// Words that are not stemmed
+	{"go", "go"},
+	{"naïve", "naïve"},
+}
+
+func TestStem(t *testing.T) {
+	for _, test := range porterTests {
+		if stem := Stem(test.word); stem != test.stem {
+			t.Errorf("Stem(%q) = %q, want %q", test.word, stem, test.stem)
+		}
+	}
+}
+
+func TestFold(t *testing.T) {
+	for _, test := range []struct{ in, out string }{
+		{"Café", "cafe"},
+		{"café", "cafe"}, // Decomposed
+		{"Ærøskøbing", "aeroskobing"},
+		{"Straße", "strasse"},
+		{"Œuvre", "oeuvre"},
+		{"Tronçon", "troncon"},
+		{"Łódź", "lodz"},
+		{"ﬁle", "file"},
+		{"ＧＥＭＩＮＩ", "gemini"},
+	} {
+		if out := Fold(test.in); out != test.out {
+			t.Errorf("Fold(%q) = %q, want %q", test.in, out, test.out)
+		}
+	}
+}
+
+func TestWords(t *testing.T) {
+	for _, test := range []struct {
+		in    string
+		words []string
+	}{
+		{"Hello, World!", []string{"hello", "world"}},
+		{"age-plugin-se", []string{"age", "plugin", "se"}},
+		{"Apple's Café", []string{"apple", "s", "cafe"}},
+		{"résumé", []string{"resume"}},
+		// Digits separate words, and are not part of any word
+		{"x509 certificates", []string{"x", "certificates"}},
+		{"in 2023", []string{"in"}},
+	} {
+		if words := Words(test.in); !slices.Equal(words, test.words) {
+			t.Errorf("Words(%q) = %q, want %q", test.in, words, test.words)
+		}
+	}
+}
+
+func TestTerms(t *testing.T) {
+	tok := New([]string{"The", "with"})
+	terms := tok.Terms("The Haskell monads, with an Ærø café")
+	want := []string{"", "haskel", "monad", "", "", "aero", "cafe"}
+	if !slices.Equal(terms, want) {
+		t.Errorf("Terms = %q, want %q", terms, want)
+	}
+}
+
+func TestReadStopWords(t *testing.T) {
+	words, err := ReadStopWords(strings.NewReader("# Comment\nthe and\n\n  over\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"the", "and", "over"}; !slices.Equal(words, want) {
+		t.Errorf("ReadStopWords = %q, want %q", words, want)
+	}
+}
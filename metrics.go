@@ -0,0 +1,282 @@
+package gemsite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the request duration histogram buckets, in seconds
+var durationBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 30}
+
+// Maximum number of paths for which requests are counted separately.
+// Requests for other paths are counted under "other".
+const maxMetricPaths = 1000
+
+// Traffic counters of the server
+type metrics struct {
+	start time.Time
+
+	mu sync.Mutex
+
+	// Requests by path and status.
+	// Only successful requests and redirects are counted by path; requests
+	// with other statuses have an empty path.
+	requests map[requestKey]int64
+	paths    map[string]bool
+
+	bytes int64
+
+	// Request durations: counts per bucket (not cumulative), the count of
+	// requests exceeding the last bucket, and the total duration
+	durations     []int64
+	durationsOver int64
+	durationSum   time.Duration
+
+	searches      int64
+	fetches       int64
+	fetchFailures int64
+}
+
+type requestKey struct {
+	path   string
+	status int
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		start:     time.Now(),
+		requests:  map[requestKey]int64{},
+		paths:     map[string]bool{},
+		durations: make([]int64, len(durationBuckets)),
+	}
+}
+
+// Records a request
+func (m *metrics) request(path string, status int, size int64, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if status != StatusSuccess && status != StatusRedirectTemporary && status != StatusRedirectPermanent {
+		path = ""
+	} else if !m.paths[path] {
+		if len(m.paths) < maxMetricPaths {
+			m.paths[path] = true
+		} else {
+			path = "other"
+		}
+	}
+	m.requests[requestKey{path, status}]++
+	m.bytes += size
+	m.durationSum += duration
+	i := sort.SearchFloat64s(durationBuckets, duration.Seconds())
+	if i < len(durationBuckets) {
+		m.durations[i]++
+	} else {
+		m.durationsOver++
+	}
+}
+
+// Records a search query
+func (m *metrics) search() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.searches++
+}
+
+// Records a fetch of Mastodon statuses
+func (m *metrics) fetch(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fetches++
+	if err != nil {
+		m.fetchFailures++
+	}
+}
+
+// A copy of the metrics, for reporting
+type metricsSnapshot struct {
+	uptime        time.Duration
+	connections   int
+	requests      map[requestKey]int64
+	total         int64
+	bytes         int64
+	durations     []int64
+	durationsOver int64
+	durationSum   time.Duration
+	searches      int64
+	fetches       int64
+	fetchFailures int64
+}
+
+func (s *Server) metricsSnapshot() metricsSnapshot {
+	s.mu.Lock()
+	connections := len(s.conns)
+	s.mu.Unlock()
+
+	m := s.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snapshot := metricsSnapshot{
+		uptime:        time.Since(m.start),
+		connections:   connections,
+		requests:      map[requestKey]int64{},
+		bytes:         m.bytes,
+		durations:     append([]int64{}, m.durations...),
+		durationsOver: m.durationsOver,
+		durationSum:   m.durationSum,
+		searches:      m.searches,
+		fetches:       m.fetches,
+		fetchFailures: m.fetchFailures,
+	}
+	for k, n := range m.requests {
+		snapshot.requests[k] = n
+		snapshot.total += n
+	}
+	return snapshot
+}
+
+// Serves the metrics as a gemtext page
+func (s *Server) serveStats(w ResponseWriter, r *Request) {
+	m := s.metricsSnapshot()
+	w.WriteHeader(StatusSuccess, gemtextType(""))
+	fmt.Fprintf(w, "# Statistics\n\n")
+	fmt.Fprintf(w, "Uptime: %v\n", m.uptime.Round(time.Second))
+	fmt.Fprintf(w, "Open connections: %d\n", m.connections)
+
+	fmt.Fprintf(w, "\n## Requests\n\n")
+	fmt.Fprintf(w, "Total: %d (%d bytes served)\n", m.total, m.bytes)
+	byStatus := map[int]int64{}
+	byPath := map[string]int64{}
+	for k, n := range m.requests {
+		byStatus[k.status] += n
+		if k.path != "" {
+			byPath[k.path] += n
+		}
+	}
+	statuses := make([]int, 0, len(byStatus))
+	for status := range byStatus {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	fmt.Fprintf(w, "\n### By status\n\n")
+	for _, status := range statuses {
+		fmt.Fprintf(w, "* %d %s: %d\n", status, StatusText(status), byStatus[status])
+	}
+	paths := make([]string, 0, len(byPath))
+	for path := range byPath {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if byPath[paths[i]] != byPath[paths[j]] {
+			return byPath[paths[i]] > byPath[paths[j]]
+		}
+		return paths[i] < paths[j]
+	})
+	if len(paths) > 20 {
+		paths = paths[:20]
+	}
+	fmt.Fprintf(w, "\n### Top paths\n\n")
+	for _, path := range paths {
+		fmt.Fprintf(w, "* %s: %d\n", path, byPath[path])
+	}
+
+	fmt.Fprintf(w, "\n## Latency\n\n")
+	if m.total > 0 {
+		fmt.Fprintf(w, "Average: %v\n\n", (m.durationSum / time.Duration(m.total)).Round(time.Microsecond))
+	}
+	for i, b := range durationBuckets {
+		fmt.Fprintf(w, "* ≤ %v: %d\n", time.Duration(b*float64(time.Second)), m.durations[i])
+	}
+	fmt.Fprintf(w, "* > %v: %d\n", time.Duration(durationBuckets[len(durationBuckets)-1]*float64(time.Second)), m.durationsOver)
+
+	fmt.Fprintf(w, "\n## Search\n\n")
+	fmt.Fprintf(w, "Queries: %d\n", m.searches)
+
+	fmt.Fprintf(w, "\n## Microblog\n\n")
+	fmt.Fprintf(w, "Mastodon fetches: %d successful, %d failed\n", m.fetches-m.fetchFailures, m.fetchFailures)
+}
+
+// Serves the metrics in the Prometheus text format
+func (s *Server) serveMetrics(w ResponseWriter, r *Request) {
+	w.WriteHeader(StatusSuccess, "text/plain; version=0.0.4")
+	s.writeMetrics(w)
+}
+
+// Writes the metrics in the Prometheus text format
+// See https://prometheus.io/docs/instrumenting/exposition_formats/
+func (s *Server) writeMetrics(w io.Writer) {
+	m := s.metricsSnapshot()
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	metric("gemsite_uptime_seconds", "gauge", "Time since the server started.")
+	fmt.Fprintf(w, "gemsite_uptime_seconds %v\n", m.uptime.Seconds())
+
+	metric("gemsite_connections", "gauge", "Open connections.")
+	fmt.Fprintf(w, "gemsite_connections %d\n", m.connections)
+
+	metric("gemsite_requests_total", "counter", "Requests by path and status. Only successful requests and redirects have a path.")
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].path != keys[j].path {
+			return keys[i].path < keys[j].path
+		}
+		return keys[i].status < keys[j].status
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "gemsite_requests_total{path=\"%s\",status=\"%d\"} %d\n", labelEscaper.Replace(k.path), k.status, m.requests[k])
+	}
+
+	metric("gemsite_response_bytes_total", "counter", "Bytes of response bodies served.")
+	fmt.Fprintf(w, "gemsite_response_bytes_total %d\n", m.bytes)
+
+	metric("gemsite_request_duration_seconds", "histogram", "Time to handle requests.")
+	var cumulative int64
+	for i, b := range durationBuckets {
+		cumulative += m.durations[i]
+		fmt.Fprintf(w, "gemsite_request_duration_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(b, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "gemsite_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", cumulative+m.durationsOver)
+	fmt.Fprintf(w, "gemsite_request_duration_seconds_sum %v\n", m.durationSum.Seconds())
+	fmt.Fprintf(w, "gemsite_request_duration_seconds_count %d\n", cumulative+m.durationsOver)
+
+	metric("gemsite_search_queries_total", "counter", "Search queries.")
+	fmt.Fprintf(w, "gemsite_search_queries_total %d\n", m.searches)
+
+	metric("gemsite_mastodon_fetches_total", "counter", "Fetches of Mastodon statuses by result.")
+	fmt.Fprintf(w, "gemsite_mastodon_fetches_total{result=\"success\"} %d\n", m.fetches-m.fetchFailures)
+	fmt.Fprintf(w, "gemsite_mastodon_fetches_total{result=\"failure\"} %d\n", m.fetchFailures)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Serves the metrics over HTTP on the metrics address, until the server shuts
+// down
+func (s *Server) listenMetrics() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.writeMetrics(w)
+	})
+	hs := &http.Server{Addr: s.config.MetricsAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-s.done
+		hs.Shutdown(context.Background())
+	}()
+	log.Printf("serving metrics on http://%s/metrics", s.config.MetricsAddr)
+	if err := hs.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("error serving metrics: %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package gemsite
+
+import (
+	"errors"
+	"log"
+	"log/slog"
+	"net"
+	"runtime/debug"
+	"time"
+)
+
+// Wraps a handler with additional behavior
+type Middleware func(Handler) Handler
+
+// Wraps a handler with the given middleware.
+// The first middleware is the outermost one.
+func Chain(handler Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// Recovers from panics in the handler, and responds with a 40
+func Recover(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				log.Printf("panic: %v\n%s", err, string(debug.Stack()))
+				Error(w, StatusTemporaryFailure, "Internal server error")
+			}
+		}()
+		next.ServeGemini(w, r)
+	})
+}
+
+// Logs every request to the default slog logger, with its response status,
+// size and duration.
+// The server logs all requests itself; this is for handlers served otherwise.
+func AccessLog(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeGemini(sw, r)
+		addr := r.RemoteAddr.String()
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			addr = host
+		}
+		cert := ""
+		if r.Certificate != nil {
+			cert = fingerprint(r.Certificate)
+		}
+		logRequest(slog.Default(), addr, r.URL.String(), sw.status, sw.size, time.Since(start), cert, r.ServerName)
+	})
+}
+
+// Only passes requests with a client certificate; responds with a 60 otherwise
+func RequireClientCert(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		if r.Certificate == nil {
+			Error(w, StatusClientCertificateRequired, "")
+			return
+		}
+		next.ServeGemini(w, r)
+	})
+}
+
+// Returns middleware only passing requests with a client certificate that has
+// at least the given role.
+// Responds with a 60 if there is no client certificate, with a 62 if the
+// certificate expired, and with a 61 if it is revoked or does not have the
+// role.
+func (s *Server) RequireRole(role Role) Middleware {
+	return func(next Handler) Handler {
+		return RequireClientCert(HandlerFunc(func(w ResponseWriter, r *Request) {
+			if actual, err := s.roleOf(r); errors.Is(err, ErrCertificateExpired) {
+				Error(w, StatusCertificateNotValid, "Certificate expired or not yet valid")
+				return
+			} else if err != nil {
+				log.Printf("%s: invalid client certificate: %v", r.RemoteAddr, err)
+				Error(w, StatusCertificateNotAuthorized, "")
+				return
+			} else if actual < role {
+				Error(w, StatusCertificateNotAuthorized, "")
+				return
+			}
+			next.ServeGemini(w, r)
+		}))
+	}
+}
+
+// Only passes requests with an admin client certificate (see RequireRole)
+func (s *Server) RequireAdmin(next Handler) Handler {
+	return s.RequireRole(RoleAdmin)(next)
+}
+
+// Records the status and body size of a response
+type statusWriter struct {
+	ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *statusWriter) WriteHeader(status int, meta string) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status, meta)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = StatusSuccess
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
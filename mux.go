@@ -0,0 +1,102 @@
+package gemsite
+
+import (
+	pathpkg "path"
+	"strings"
+	"sync"
+)
+
+// Request multiplexer, dispatching requests to the handler registered for the
+// longest matching pattern.
+//
+// A pattern ending with a slash (e.g. "/blog/") matches all paths with that
+// prefix, including the pattern without the trailing slash ("/blog").
+// Other patterns (e.g. "/search") only match the exact path.
+// Requests without a matching pattern get a 51 response.
+type ServeMux struct {
+	mu     sync.RWMutex
+	exact  map[string]Handler
+	prefix map[string]Handler
+}
+
+func NewServeMux() *ServeMux {
+	return &ServeMux{exact: map[string]Handler{}, prefix: map[string]Handler{}}
+}
+
+// Registers the handler for the given pattern.
+// Panics if the pattern is invalid or already registered.
+func (mux *ServeMux) Handle(pattern string, handler Handler) {
+	if !strings.HasPrefix(pattern, "/") {
+		panic("gemsite: invalid pattern " + pattern)
+	}
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	patterns := mux.exact
+	if strings.HasSuffix(pattern, "/") {
+		patterns = mux.prefix
+	}
+	if _, ok := patterns[pattern]; ok {
+		panic("gemsite: multiple registrations for " + pattern)
+	}
+	patterns[pattern] = handler
+}
+
+func (mux *ServeMux) HandleFunc(pattern string, handler func(ResponseWriter, *Request)) {
+	mux.Handle(pattern, HandlerFunc(handler))
+}
+
+// Returns the handler and pattern for the given path, or nil if no pattern
+// matches
+func (mux *ServeMux) Handler(path string) (Handler, string) {
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+	if h, ok := mux.exact[path]; ok {
+		return h, path
+	}
+	var handler Handler
+	var pattern string
+	for p, h := range mux.prefix {
+		if (strings.HasPrefix(path, p) || path+"/" == p) && len(p) > len(pattern) {
+			handler, pattern = h, p
+		}
+	}
+	return handler, pattern
+}
+
+func (mux *ServeMux) ServeGemini(w ResponseWriter, r *Request) {
+	path := r.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	h, _ := mux.Handler(path)
+	if h == nil {
+		Error(w, StatusNotFound, "")
+		return
+	}
+	h.ServeGemini(w, r)
+}
+
+// Returns a handler that serves requests by removing the given prefix from the
+// URL path, and passing them to h (e.g. to serve a directory on a path other
+// than the root).
+// Requests for paths without the prefix get a 51 response. Requests for the
+// prefix itself are redirected to the prefix with a trailing slash, so
+// relative links resolve below the prefix.
+func StripPrefix(prefix string, h Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		path, ok := strings.CutPrefix(r.URL.Path, prefix)
+		if !ok {
+			Error(w, StatusNotFound, "")
+			return
+		}
+		if path == "" {
+			Redirect(w, pathpkg.Base(r.URL.Path)+"/", StatusRedirectPermanent)
+			return
+		}
+		r2 := *r
+		u := *r.URL
+		u.Path, u.RawPath = path, ""
+		r2.URL = &u
+		h.ServeGemini(w, &r2)
+	})
+}
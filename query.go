@@ -0,0 +1,365 @@
+package gemsite
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/remko/gemsite/internal/tokenizer"
+)
+
+// A parsed search query.
+// Pages match if they match every clause, and none of the excluded terms.
+type searchQuery struct {
+	// Alternatives (terms combined with OR) that must match
+	clauses [][]searchTerm
+
+	excluded []searchTerm
+
+	// Words that are too short or too common to search for
+	ignored []string
+}
+
+// Search fields
+const (
+	fieldText  = ""
+	fieldTitle = "title"
+	fieldTag   = "tag"
+	fieldYear  = "year"
+)
+
+// A word, prefix or phrase to search for in the text or title, or a tag or
+// year to filter on
+type searchTerm struct {
+	field string
+
+	// Terms of the phrase (a single term for word searches).
+	// Words that are not indexed have an empty term, and match any word.
+	words []string
+
+	// Whether the last word is a prefix.
+	// Prefixes are normalized, but not stemmed.
+	prefix bool
+
+	// Tag or year
+	value string
+}
+
+// Minimum number of letters before the * of a prefix search
+const minPrefixLength = 2
+
+// Parses a search query.
+// A query consists of words, prefixes ("enc*"), and phrases ("secure
+// enclave"), optionally restricted to the title ("title:age") and combined
+// with OR, tags ("tag:go") and years ("year:2023") to filter on, and
+// exclusions ("-linux"). Words separated by punctuation (e.g. "age-plugin")
+// are searched for as a phrase.
+// Words are turned into terms by the tokenizer of the index.
+// The errors are meant to be shown to the user.
+func parseQuery(s string, tok *tokenizer.Tokenizer) (*searchQuery, error) {
+	q := &searchQuery{}
+	or := false
+	ignored := "" // The previous term, if it was ignored
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		// Operator
+		if rest, ok := strings.CutPrefix(s, "OR"); ok && (rest == "" || rest[0] == ' ') {
+			if ignored != "" {
+				return nil, fmt.Errorf("%q is too short or common to combine with OR", ignored)
+			}
+			if len(q.clauses) == 0 || or {
+				return nil, errors.New("OR must be between two search terms")
+			}
+			or, s = true, rest
+			continue
+		}
+
+		// Exclusion and field
+		exclude := false
+		if strings.HasPrefix(s, "-") {
+			exclude, s = true, s[1:]
+		}
+		// Other prefixes (e.g. of URLs, or "note:") are part of the text
+		field := fieldText
+		if i := strings.IndexFunc(s, func(r rune) bool { return !unicode.IsLetter(r) }); i > 0 && s[i] == ':' {
+			switch name := strings.ToLower(s[:i]); name {
+			case fieldTitle, fieldTag, fieldYear:
+				field, s = name, s[i+1:]
+			}
+		}
+
+		// Value
+		var value string
+		quoted := strings.HasPrefix(s, `"`)
+		if quoted {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				return nil, errors.New("missing closing quote")
+			}
+			value, s = s[1:end+1], s[end+2:]
+		} else {
+			end := strings.IndexByte(s, ' ')
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = s[:end], s[end:]
+		}
+
+		if value == "" && !quoted {
+			if field != fieldText {
+				return nil, fmt.Errorf("%s: needs a value", field)
+			}
+			return nil, errors.New("- must be followed by the term to exclude")
+		}
+		t, err := parseTerm(field, value, quoted, tok)
+		if err != nil {
+			return nil, err
+		}
+		if t == nil {
+			q.ignored = append(q.ignored, value)
+			if or {
+				return nil, fmt.Errorf("%q is too short or common to combine with OR", value)
+			}
+			ignored = value
+			continue
+		}
+		ignored = ""
+		switch {
+		case exclude && or:
+			return nil, errors.New("excluded terms can't be combined with OR")
+		case exclude:
+			q.excluded = append(q.excluded, *t)
+		case or:
+			q.clauses[len(q.clauses)-1] = append(q.clauses[len(q.clauses)-1], *t)
+		default:
+			q.clauses = append(q.clauses, []searchTerm{*t})
+		}
+		or = false
+	}
+	if or {
+		return nil, errors.New("OR must be between two search terms")
+	}
+	if len(q.clauses) == 0 {
+		if len(q.excluded) > 0 {
+			return nil, errors.New("search for at least one term besides excluded ones")
+		}
+		return nil, fmt.Errorf("search for words of at least %d letters that are not too common", MinSearchWordLength)
+	}
+	return q, nil
+}
+
+// Parses the value of a search term.
+// Returns nil if it has no words that are indexed.
+func parseTerm(field string, value string, quoted bool, tok *tokenizer.Tokenizer) (*searchTerm, error) {
+	switch field {
+	case fieldYear:
+		if len(value) != 4 || strings.Trim(value, "0123456789") != "" {
+			return nil, fmt.Errorf("year: needs a year (e.g. year:2023), not %q", value)
+		}
+		return &searchTerm{field: field, value: value}, nil
+	case fieldTag:
+		return &searchTerm{field: field, value: tokenizer.Fold(value)}, nil
+	}
+
+	words := tokenizer.Words(value)
+	t := &searchTerm{field: field, words: make([]string, len(words))}
+	t.prefix = !quoted && strings.HasSuffix(value, "*")
+	if t.prefix && (len(words) == 0 || utf8.RuneCountInString(words[len(words)-1]) < minPrefixLength) {
+		return nil, fmt.Errorf("prefix searches need at least %d letters before the *: %q", minPrefixLength, value)
+	}
+	searchable := false
+	for i, word := range words {
+		if t.prefix && i == len(words)-1 {
+			t.words[i] = word
+		} else {
+			t.words[i] = tok.Term(word)
+		}
+		if t.words[i] != "" {
+			searchable = true
+		}
+	}
+	if !searchable {
+		return nil, nil
+	}
+	return t, nil
+}
+
+// Returns the indexed terms matching a word of a term: all terms with the
+// prefix (or equal to its stem) for prefix searches, and the term itself
+// otherwise
+func (index *searchIndex) expand(word string, prefix bool) []string {
+	var result []string
+	stem := word
+	if prefix {
+		stem = tokenizer.Stem(word)
+	}
+	if len(index.postings(stem)) > 0 && (!prefix || !strings.HasPrefix(stem, word)) {
+		result = append(result, stem)
+	}
+	if !prefix {
+		return result
+	}
+	return append(result, index.terms(word)...)
+}
+
+// Returns the words to emphasize in snippets for a term
+func (index *searchIndex) highlights(t searchTerm) []string {
+	if t.field != fieldText {
+		return nil
+	}
+	var result []string
+	for i, word := range t.words {
+		if word != "" {
+			result = append(result, index.expand(word, t.prefix && i == len(t.words)-1)...)
+		}
+	}
+	return result
+}
+
+// BM25 parameters: term frequency saturation, and document length
+// normalization
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// Number of occurrences a match in the title counts for
+const titleBoost = 3
+
+// Returns the pages matching a term, with their relevance score.
+// Text and title matches are scored using BM25, where every match in the
+// title counts as titleBoost matches. Tag and year filters don't add to the
+// score.
+func (index *searchIndex) match(t searchTerm) map[*Page]float64 {
+	result := map[*Page]float64{}
+	switch t.field {
+	case fieldTag:
+		for _, page := range index.pages {
+			for _, tag := range page.Tags {
+				if tag == t.value {
+					result[page] = 0
+				}
+			}
+		}
+		return result
+	case fieldYear:
+		for _, page := range index.pages {
+			if strings.HasPrefix(page.Date, t.value+"-") {
+				result[page] = 0
+			}
+		}
+		return result
+	}
+
+	counts := map[*Page]int{}
+	for _, page := range index.pages {
+		if n := titleMatches(page, t); n > 0 {
+			counts[page] = titleBoost * n
+		}
+	}
+	if t.field == fieldText {
+		for page, n := range index.textMatches(t) {
+			counts[page] += n
+		}
+	}
+	n := float64(len(counts))
+	idf := math.Log(1 + (float64(len(index.pages))-n+0.5)/(n+0.5))
+	for page, count := range counts {
+		tf := float64(count)
+		norm := 1 - bm25B + bm25B*float64(page.length)/index.averageLength
+		result[page] = idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+	}
+	return result
+}
+
+// Returns the number of occurrences of a term in the text of the pages
+// containing it, using the positions of the words
+func (index *searchIndex) textMatches(t searchTerm) map[*Page]int {
+	// The indexed terms matching every word of the term (nil for words that
+	// match any word), and their postings
+	slots := make([][]string, len(t.words))
+	postings := map[string]map[*Page][]int{}
+	first := -1
+	for i, word := range t.words {
+		if word == "" {
+			continue
+		}
+		if slots[i] = index.expand(word, t.prefix && i == len(t.words)-1); slots[i] == nil {
+			return nil
+		}
+		for _, term := range slots[i] {
+			if _, ok := postings[term]; !ok {
+				postings[term] = index.postings(term)
+			}
+		}
+		if first < 0 {
+			first = i
+		}
+	}
+
+	result := map[*Page]int{}
+	for _, term := range slots[first] {
+	pages:
+		for page := range postings[term] {
+			if _, ok := result[page]; ok {
+				continue
+			}
+			// Positions of the words in the page, by slot
+			positions := make([]map[int]bool, len(slots))
+			for i, words := range slots {
+				if words == nil {
+					continue
+				}
+				positions[i] = map[int]bool{}
+				for _, w := range words {
+					for _, p := range postings[w][page] {
+						positions[i][p] = true
+					}
+				}
+				if len(positions[i]) == 0 {
+					continue pages
+				}
+			}
+			n := 0
+		starts:
+			for p := range positions[first] {
+				start := p - first
+				for i, ps := range positions {
+					if ps != nil && !ps[start+i] {
+						continue starts
+					}
+				}
+				n++
+			}
+			if n > 0 {
+				result[page] = n
+			}
+		}
+	}
+	return result
+}
+
+// Returns the number of occurrences of a term in the title of a page
+func titleMatches(page *Page, t searchTerm) int {
+	n := 0
+	for start := 0; start+len(t.words) <= len(page.titleTokens); start++ {
+		match := true
+		for i, word := range t.words {
+			token := page.titleTokens[start+i]
+			if t.prefix && i == len(t.words)-1 {
+				match = strings.HasPrefix(token, word) || token == tokenizer.Stem(word)
+			} else {
+				match = word == "" || token == word
+			}
+			if !match {
+				break
+			}
+		}
+		if match {
+			n++
+		}
+	}
+	return n
+}
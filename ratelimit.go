@@ -0,0 +1,171 @@
+package gemsite
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Classes of routes with separate request budgets
+const (
+	routeStatic  = "static"
+	routeSearch  = "search"
+	routeDynamic = "dynamic"
+)
+
+// Clients that have been idle for this long are forgotten
+const clientIdleTime = 10 * time.Minute
+
+// Limits the requests of each client using a token bucket
+type rateLimiter struct {
+	limit RateLimit
+
+	mu        sync.Mutex
+	clients   map[string]*client
+	lastSweep time.Time
+}
+
+// Request budget and statistics of a client
+type client struct {
+	tokens   float64
+	last     time.Time
+	requests int64
+	limited  int64
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	return &rateLimiter{limit: limit, clients: map[string]*client{}}
+}
+
+// Takes a token from the bucket of the client.
+// If there is none, returns false and the time until the next token is
+// available.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) > clientIdleTime {
+		l.sweep(now)
+	}
+	c := l.clients[key]
+	if c == nil {
+		c = &client{tokens: float64(l.limit.Burst), last: now}
+		l.clients[key] = c
+	}
+	c.tokens = math.Min(float64(l.limit.Burst), c.tokens+now.Sub(c.last).Seconds()*l.limit.Rate)
+	c.last = now
+	c.requests++
+	if c.tokens < 1 {
+		c.limited++
+		return false, time.Duration((1 - c.tokens) / l.limit.Rate * float64(time.Second))
+	}
+	c.tokens--
+	return true, 0
+}
+
+// Forgets idle clients.
+// Must be called with mu held.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, c := range l.clients {
+		if now.Sub(c.last) > clientIdleTime {
+			delete(l.clients, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// Statistics of a client, for reporting
+type clientStats struct {
+	key      string
+	requests int64
+	limited  int64
+	last     time.Time
+}
+
+// Returns the n clients with the most requests
+func (l *rateLimiter) heaviest(n int) []clientStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result := make([]clientStats, 0, len(l.clients))
+	for key, c := range l.clients {
+		result = append(result, clientStats{key: key, requests: c.requests, limited: c.limited, last: c.last})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].requests != result[j].requests {
+			return result[i].requests > result[j].requests
+		}
+		return result[i].key < result[j].key
+	})
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+// Returns the middleware limiting the requests of a class of routes.
+// Requests over budget are answered with a 44.
+func (s *Server) rateLimit(class string) Middleware {
+	l := s.limiters[class]
+	return func(next Handler) Handler {
+		if l == nil {
+			return next
+		}
+		return HandlerFunc(func(w ResponseWriter, r *Request) {
+			if ok, wait := l.allow(s.clientKey(r), time.Now()); !ok {
+				Error(w, StatusSlowDown, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				return
+			}
+			next.ServeGemini(w, r)
+		})
+	}
+}
+
+// Returns the key identifying the client of a request for rate limiting.
+// Only certificates that are allowlisted or signed by a client CA identify a
+// client: anyone can create new self-signed certificates to get a new budget.
+func (s *Server) clientKey(r *Request) string {
+	if s.config.RateLimits.ByCertificate && r.Certificate != nil {
+		fp := fingerprint(r.Certificate)
+		entry, listed := s.allowlist.lookup(fp)
+		if listed && !entry.revoked || !listed && r.VerifyCertificate() == nil {
+			return "SHA256:" + fp
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr.String())
+	if err != nil {
+		return r.RemoteAddr.String()
+	}
+	return host
+}
+
+// Lists the clients with the most requests, per class of routes
+func (s *Server) serveClients(w ResponseWriter, r *Request) {
+	w.WriteHeader(StatusSuccess, gemtextType(""))
+	fmt.Fprintf(w, "# Clients\n\n")
+	s.mu.Lock()
+	fmt.Fprintf(w, "Open connections: %d", len(s.conns))
+	s.mu.Unlock()
+	if s.config.MaxConnections > 0 {
+		fmt.Fprintf(w, " (maximum %d)", s.config.MaxConnections)
+	}
+	fmt.Fprintf(w, "\n")
+	now := time.Now()
+	for _, class := range []string{routeStatic, routeSearch, routeDynamic} {
+		l := s.limiters[class]
+		if l == nil {
+			continue
+		}
+		fmt.Fprintf(w, "\n## %s\n\n", class)
+		fmt.Fprintf(w, "%v requests per second, bursts of %d. Clients seen in the last %v:\n\n", l.limit.Rate, l.limit.Burst, clientIdleTime)
+		clients := l.heaviest(20)
+		if len(clients) == 0 {
+			fmt.Fprintf(w, "None\n")
+		}
+		for _, c := range clients {
+			fmt.Fprintf(w, "* %s: %d requests, %d slowed down, last %v ago\n", c.key, c.requests, c.limited, now.Sub(c.last).Round(time.Second))
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package gemsite
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/remko/gemsite/internal/searchindex"
+	"github.com/remko/gemsite/internal/site"
+)
+
+// Uploads using Titan
+// Protocol: https://transjovian.org/titan/page/The%20Titan%20Specification
+
+// Name of the search index of uploaded pages, in the upload directory
+const uploadIndexFile = ".search.idx"
+
+// Files uploaded using Titan, stored in a directory that overlays the capsule
+// content
+type uploads struct {
+	dir     string
+	maxSize int64
+
+	// Serializes uploads. Protects entries.
+	mu sync.Mutex
+
+	// Search index documents of the uploaded pages, by path
+	entries map[string]searchindex.Document
+
+	// The stored search index of the uploaded pages
+	data []byte
+}
+
+// Loads the search index of the uploaded pages
+func (u *uploads) loadIndex() error {
+	u.entries = map[string]searchindex.Document{}
+	path := filepath.Join(u.dir, uploadIndexFile)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	index, err := searchindex.Read(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, doc := range index.Documents() {
+		u.entries[doc.URL] = doc
+	}
+	u.data = data
+	return nil
+}
+
+// Returns the search index of the uploaded pages, built with the given stop
+// words.
+// Must be called with mu held.
+func (u *uploads) index(stopWords []string) ([]byte, error) {
+	paths := make([]string, 0, len(u.entries))
+	for path := range u.entries {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	docs := make([]searchindex.Document, 0, len(paths))
+	for _, path := range paths {
+		docs = append(docs, u.entries[path])
+	}
+	var b bytes.Buffer
+	if err := searchindex.Write(&b, stopWords, docs); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Writes a file in the upload directory, replacing it atomically
+func (u *uploads) writeFile(name string, data []byte) error {
+	path := filepath.Join(u.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Handles a Titan upload.
+// Markdown files are converted to gemtext, and gemtext files are added to the
+// search index and blog listings. Uploading an empty file deletes it.
+func (c *capsule) serveUpload(w ResponseWriter, r *Request) {
+	u := c.uploads
+	path, rawParams, _ := strings.Cut(r.URL.Path, ";")
+	params := map[string]string{}
+	for _, p := range strings.Split(rawParams, ";") {
+		k, v, _ := strings.Cut(p, "=")
+		params[k] = v
+	}
+	size, err := strconv.ParseInt(params["size"], 10, 64)
+	if err != nil || size < 0 {
+		Error(w, StatusBadRequest, "Missing or invalid size")
+		return
+	}
+	if size > u.maxSize {
+		Error(w, StatusBadRequest, fmt.Sprintf("Upload exceeds %d bytes", u.maxSize))
+		return
+	}
+	mimeType := params["mime"]
+	if mimeType == "" {
+		mimeType = "text/gemini"
+	}
+	name := strings.TrimPrefix(path, "/")
+	if !fs.ValidPath(name) || name == "." || strings.HasSuffix(path, "/") {
+		Error(w, StatusBadRequest, "Invalid upload path")
+		return
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			Error(w, StatusBadRequest, "Invalid upload path")
+			return
+		}
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r.Body, data); err != nil {
+		log.Printf("%s: error receiving upload: %v", r.RemoteAddr, err)
+		Error(w, StatusBadRequest, "Incomplete upload")
+		return
+	}
+
+	// Determine the file to store, and the page to index (if any)
+	var page *site.Page
+	ext := filepath.Ext(name)
+	if ext == ".md" || mimeType == "text/markdown" {
+		base := strings.TrimSuffix(name, ".md")
+		name = base + ".gmi"
+		page = &site.Page{URL: "/" + base}
+		if size > 0 {
+			var out bytes.Buffer
+			p, err := site.ConvertMarkdownToGemtext(bytes.NewReader(data), &out)
+			if err != nil {
+				Error(w, StatusBadRequest, fmt.Sprintf("Invalid Markdown: %v", err))
+				return
+			}
+			p.URL = page.URL
+			page, data = &p, out.Bytes()
+		}
+	} else if ext == ".gmi" || (ext == "" && strings.HasPrefix(mimeType, "text/gemini")) {
+		base := strings.TrimSuffix(name, ".gmi")
+		name = base + ".gmi"
+		page = &site.Page{URL: "/" + base}
+		if size > 0 {
+			p, err := site.ParseGemtext(bytes.NewReader(data))
+			if err != nil {
+				Error(w, StatusBadRequest, fmt.Sprintf("Invalid gemtext: %v", err))
+				return
+			}
+			p.URL = page.URL
+			page = &p
+		}
+	}
+	if slices.Contains(site.Generated, name) {
+		Error(w, StatusBadRequest, "Cannot replace generated page")
+		return
+	}
+
+	// Index the page before storing it, so invalid content is not stored
+	var doc searchindex.Document
+	if page != nil && size > 0 {
+		terms, text, err := site.IndexContent(bytes.NewReader(data), c.index().tokenizer)
+		if err != nil {
+			Error(w, StatusBadRequest, fmt.Sprintf("Invalid content: %v", err))
+			return
+		}
+		doc = site.IndexDocument(*page, terms, text)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	// Store or delete the file
+	if size == 0 {
+		if err := os.Remove(filepath.Join(u.dir, filepath.FromSlash(name))); err != nil {
+			FileError(w, err)
+			return
+		}
+		log.Printf("%s: deleted %s", r.RemoteAddr, name)
+	} else {
+		if err := u.writeFile(name, data); err != nil {
+			log.Printf("error storing upload: %v", err)
+			Error(w, StatusTemporaryFailure, "Unable to store upload")
+			return
+		}
+		log.Printf("%s: uploaded %s (%d bytes)", r.RemoteAddr, name, len(data))
+	}
+
+	// Update the search index and listings
+	if page != nil {
+		if size == 0 {
+			delete(u.entries, page.URL)
+		} else {
+			u.entries[page.URL] = doc
+		}
+		if err := c.updateIndex(); err != nil {
+			log.Printf("error updating index: %v", err)
+			Error(w, StatusTemporaryFailure, "Unable to update index")
+			return
+		}
+	}
+
+	if size == 0 {
+		w.WriteHeader(StatusSuccess, gemtextType(""))
+		fmt.Fprintf(w, "# Deleted\n\n%s was deleted.\n", name)
+		return
+	}
+	target := "/" + name
+	if page != nil {
+		target = page.URL
+	}
+	Redirect(w, "gemini://"+r.URL.Host+target, StatusRedirectTemporary)
+}
+
+// Stores the search index of the uploaded pages, and reloads the search index
+// (regenerating the listings).
+// Must be called with the uploads lock held.
+func (c *capsule) updateIndex() error {
+	u := c.uploads
+	data, err := u.index(c.index().stopWords)
+	if err != nil {
+		return err
+	}
+	if err := u.writeFile(uploadIndexFile, data); err != nil {
+		return err
+	}
+	u.data = data
+	return c.reindex()
+}
+
+// Renders the listings (see site.Generated) of the pages of a search index
+func (c *capsule) renderListings(index *searchIndex) (map[string][]byte, error) {
+	pages := []site.Page{}
+	for _, p := range index.pages {
+		t, _ := time.Parse(time.DateOnly, p.Date)
+		pages = append(pages, site.Page{
+			URL:      p.Path,
+			Path:     strings.TrimPrefix(p.Path, "/") + ".gmi",
+			Time:     t,
+			Title:    p.Title,
+			Featured: p.Featured,
+			Tags:     p.Tags,
+		})
+	}
+	s := site.NewSite(pages)
+	result := map[string][]byte{}
+	for _, name := range site.Generated {
+		var out bytes.Buffer
+		if err := s.Render(c.templates, name, &out); err != nil {
+			return nil, err
+		}
+		result[name] = out.Bytes()
+	}
+	return result, nil
+}
+
+// Returns the listing with the given name, as generated from the capsule
+// content and the uploaded pages
+func (c *capsule) generatedListing(name string) ([]byte, bool) {
+	c.indexMu.RLock()
+	defer c.indexMu.RUnlock()
+	data, ok := c.listings[name]
+	return data, ok
+}
+
+// A file system that serves the listings of a capsule with uploads from
+// memory, and other files from fsys.
+// The listings of the capsule content don't include the uploaded pages, so
+// they are regenerated whenever the search index changes.
+type listingsFS struct {
+	c    *capsule
+	fsys fs.FS
+}
+
+func (l listingsFS) Open(name string) (fs.File, error) {
+	if data, ok := l.c.generatedListing(name); ok {
+		return &memFile{Reader: bytes.NewReader(data), name: path.Base(name)}, nil
+	}
+	return l.fsys.Open(name)
+}
+
+func (l listingsFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(l.fsys, name)
+}
+
+// A file stored in memory
+type memFile struct {
+	*bytes.Reader
+	name string
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f, nil }
+func (f *memFile) Close() error               { return nil }
+func (f *memFile) Name() string               { return f.name }
+func (f *memFile) Mode() fs.FileMode          { return 0444 }
+func (f *memFile) ModTime() time.Time         { return time.Time{} }
+func (f *memFile) IsDir() bool                { return false }
+func (f *memFile) Sys() any                   { return nil }
+
+// A file system that serves the files from upper, falling back to lower.
+// Hidden files (starting with a dot) in upper are ignored.
+type overlayFS struct {
+	upper fs.FS
+	lower fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	if !isHidden(name) {
+		f, err := o.upper.Open(name)
+		if err == nil {
+			return f, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return o.lower.Open(name)
+}
+
+// Merges the entries of the directory in both file systems
+func (o overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	lower, lerr := fs.ReadDir(o.lower, name)
+	upper, uerr := fs.ReadDir(o.upper, name)
+	if lerr != nil && uerr != nil {
+		return nil, uerr
+	}
+	entries := map[string]fs.DirEntry{}
+	for _, e := range lower {
+		entries[e.Name()] = e
+	}
+	for _, e := range upper {
+		if !isHidden(e.Name()) {
+			entries[e.Name()] = e
+		}
+	}
+	result := make([]fs.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		result = append(result, e)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name() < result[j].Name() })
+	return result, nil
+}
+
+func isHidden(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") && segment != "." {
+			return true
+		}
+	}
+	return false
+}
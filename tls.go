@@ -0,0 +1,157 @@
+package gemsite
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/remko/gemsite/internal/certgen"
+)
+
+// Server certificate and client CA pool, loaded from disk (or from the
+// embedded defaults), and reloadable without restarting the server.
+// Connections in flight keep using the configuration they were set up with.
+type certificates struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	mu       sync.RWMutex
+	config   *tls.Config
+	caCerts  []*x509.Certificate
+	caPool   *x509.CertPool
+	modTimes []time.Time
+}
+
+func newCertificates(certFile, keyFile, clientCAFile string) (*certificates, error) {
+	c := &certificates{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Returns the TLS configuration with the latest loaded certificates
+func (c *certificates) current() *tls.Config {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.config
+}
+
+// Returns the parsed server certificate
+func (c *certificates) leaf() *x509.Certificate {
+	return c.current().Certificates[0].Leaf
+}
+
+// Returns the client CA certificates
+func (c *certificates) clientCAs() []*x509.Certificate {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.caCerts
+}
+
+// Returns the pool of client CA certificates, to verify client certificates
+// against
+func (c *certificates) clientCAPool() *x509.CertPool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.caPool
+}
+
+// (Re)loads the certificates.
+// If loading fails, the previously loaded certificates are kept.
+func (c *certificates) load() error {
+	modTimes := c.currentModTimes()
+	certPEM, keyPEM := servercert, serverkey
+	if c.certFile != "" {
+		var err error
+		if certPEM, err = os.ReadFile(c.certFile); err != nil {
+			return err
+		}
+		if keyPEM, err = os.ReadFile(c.keyFile); err != nil {
+			return err
+		}
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("unable to load server certificate: %w", err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return fmt.Errorf("unable to parse server certificate: %w", err)
+	}
+
+	// The client CA defaults to the server certificate
+	caPEM := certPEM
+	if c.clientCAFile != "" {
+		if caPEM, err = os.ReadFile(c.clientCAFile); err != nil {
+			return err
+		}
+	}
+	caCerts, err := certgen.Parse(caPEM)
+	if err != nil {
+		return fmt.Errorf("unable to add client ca cert: %w", err)
+	}
+	clientCAs := x509.NewCertPool()
+	for _, ca := range caCerts {
+		clientCAs.AddCert(ca)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.config = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		// Client certificates are verified by the handlers that need them,
+		// so they can respond with the appropriate status.
+		// The client CAs are not advertised, as clients would then withhold
+		// (allowlisted) certificates that are not signed by one of them.
+		ClientAuth: tls.RequestClientCert,
+	}
+	c.caCerts = caCerts
+	c.caPool = clientCAs
+	c.modTimes = modTimes
+	return nil
+}
+
+// Reloads the certificates if any of the files changed since the last load
+func (c *certificates) reloadIfChanged() error {
+	modTimes := c.currentModTimes()
+	c.mu.RLock()
+	changed := false
+	for i := range modTimes {
+		if !modTimes[i].Equal(c.modTimes[i]) {
+			changed = true
+		}
+	}
+	c.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+	log.Printf("certificate files changed; reloading")
+	return c.load()
+}
+
+func (c *certificates) currentModTimes() []time.Time {
+	var result []time.Time
+	for _, f := range []string{c.certFile, c.keyFile, c.clientCAFile} {
+		var t time.Time
+		if f != "" {
+			if fi, err := os.Stat(f); err == nil {
+				t = fi.ModTime()
+			}
+		}
+		result = append(result, t)
+	}
+	return result
+}
+
+// Returns the SHA-256 fingerprint of a certificate, hex-encoded
+func fingerprint(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(hash[:])
+}